@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/auth"
+
+	"github.com/labstack/echo"
+)
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	// send as a bearer token, or the token query parameter for the websocket and camera
+	Token     string          `json:"token"`
+	Principal *auth.Principal `json:"principal"`
+}
+
+func Login() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request LoginRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		token, principal, err := auth.Login(request.Username, request.Password)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, LoginResponse{
+			Token:     token,
+			Principal: principal,
+		})
+	}
+}
+
+func Logout() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth.Logout(auth.RequestToken(c.Request()))
+
+		return c.JSON(http.StatusOK, JSONResponse{
+			"status": "OK",
+		})
+	}
+}
+
+// Me returns who the request was authenticated as
+func Me() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, c.Get(auth.ContextKey))
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+func BatteryHistory() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var history *control.BatteryHistoryStruct
+		control.Do(func() {
+			history = control.BatteryHistory()
+		})
+
+		return c.JSON(http.StatusOK, history)
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/auth"
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	// how each websocket error code is reported over HTTP
+	commandErrorStatus = map[string]int{
+		control.ErrorCodeUnknownMethod:  http.StatusNotFound,
+		control.ErrorCodeInvalidPayload: http.StatusBadRequest,
+		control.ErrorCodeForbidden:      http.StatusForbidden,
+		control.ErrorCodeNotInControl:   http.StatusConflict,
+		control.ErrorCodeRejected:       http.StatusConflict,
+	}
+)
+
+type CommandsResponse struct {
+	Methods []string `json:"methods"`
+}
+
+func State() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, control.State())
+	}
+}
+
+func Commands() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, CommandsResponse{
+			Methods: control.CommandMethods(),
+		})
+	}
+}
+
+// Command runs any websocket command method, the request body is its payload
+func Command() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, c.Param("method"), http.StatusOK)
+	}
+}
+
+func SetDriveSpeed() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "setMowerDriveSpeed", http.StatusOK)
+	}
+}
+
+func SetCutterSpeed() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "setMowerCutterSpeed", http.StatusOK)
+	}
+}
+
+func EmergencyStop() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "emergencyStop", http.StatusOK)
+	}
+}
+
+// runCommand runs a command through the same validation, lease and role checks as the websocket
+func runCommand(c echo.Context, method string, status int) error {
+	data, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, JSONResponse{
+			"error": err.Error(),
+		})
+	}
+
+	return executeCommand(c, method, data, status)
+}
+
+// executeCommand runs a command whose payload comes from somewhere other than the request body, such as the path
+func executeCommand(c echo.Context, method string, data []byte, status int) error {
+	caller := callerIdentity(c)
+
+	var result interface{}
+	var commandErr *control.ProtocolError
+	control.Do(func() {
+		result, commandErr = control.ExecuteCommand(caller, method, json.RawMessage(data))
+	})
+
+	if commandErr != nil {
+		code, ok := commandErrorStatus[commandErr.Code]
+		if !ok {
+			code = http.StatusBadRequest
+		}
+
+		return c.JSON(code, JSONResponse{
+			"error": commandErr.Message,
+			"code":  commandErr.Code,
+		})
+	}
+
+	if result == nil {
+		return c.JSON(status, JSONResponse{
+			"status": "OK",
+		})
+	}
+
+	return c.JSON(status, result)
+}
+
+// callerIdentity is who a REST request acts as, every request from the same account shares one control lease
+func callerIdentity(c echo.Context) control.ControllerIdentity {
+	identity := control.ControllerIdentity{ID: "rest", Address: c.RealIP()}
+
+	if principal, ok := c.Get(auth.ContextKey).(*auth.Principal); ok {
+		identity.ID = "rest:" + principal.Name
+		identity.User = principal.Name
+		identity.Role = principal.Role
+	}
+
+	return identity
+}
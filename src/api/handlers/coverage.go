@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+func CoveragePNG() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var img image.Image
+		var err error
+		control.Do(func() {
+			var m *control.CoverageMapStruct
+			if m, err = control.CoverageMap(c.Param("zone")); err == nil {
+				img = m.Image()
+			}
+		})
+
+		if err != nil {
+			return c.JSON(http.StatusNotFound, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+
+		return c.Blob(http.StatusOK, "image/png", buf.Bytes())
+	}
+}
+
+func CoverageGeoJSON() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var data []byte
+		var err error
+		control.Do(func() {
+			var m *control.CoverageMapStruct
+			if m, err = control.CoverageMap(c.Param("zone")); err == nil {
+				data, err = json.Marshal(m.GeoJSON())
+			}
+		})
+
+		if err != nil {
+			return c.JSON(http.StatusNotFound, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.Blob(http.StatusOK, "application/geo+json", data)
+	}
+}
+
+func CoverageGaps() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request control.JobRequest
+		var err error
+		control.Do(func() {
+			var m *control.CoverageMapStruct
+			if m, err = control.CoverageMap(c.Param("zone")); err == nil {
+				request = control.JobRequest{
+					Zone: m.Zone,
+					Plan: m.GapPlan(),
+				}
+			}
+		})
+
+		if err != nil {
+			return c.JSON(http.StatusNotFound, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, request)
+	}
+}
+
+func ResetCoverage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		data, err := json.Marshal(control.CoveragePayload{Zone: c.Param("zone")})
+		if err != nil {
+			return err
+		}
+
+		return executeCommand(c, "resetCoverage", data, http.StatusOK)
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+type DockResponse struct {
+	Dock     control.Pose `json:"dock"`
+	Approach control.Pose `json:"approach"`
+	Status   string       `json:"status"`
+	Charging bool         `json:"charging"`
+}
+
+func Dock() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		state := control.State()
+
+		return c.JSON(http.StatusOK, DockResponse{
+			Dock:     control.DockPose(),
+			Approach: control.DockApproachPose(),
+			Status:   state.Dock.Status,
+			Charging: state.Dock.Charging,
+		})
+	}
+}
+
+func ReturnHome() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "returnHome", http.StatusOK)
+	}
+}
+
+func CancelReturnHome() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "cancelReturnHome", http.StatusOK)
+	}
+}
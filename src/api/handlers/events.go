@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+type EventsResponse struct {
+	Events []control.EventStruct `json:"events"`
+}
+
+// Events queries the event log, since and until are RFC 3339 times, severity is the least severity wanted and type a comma separated list
+func Events() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query := control.EventQuery{Severity: c.QueryParam("severity")}
+
+		var err error
+		for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+			if value := c.QueryParam(name); value != "" {
+				*t, err = time.Parse(time.RFC3339, value)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, JSONResponse{
+						"error": name + " must be an RFC 3339 time",
+					})
+				}
+			}
+		}
+
+		if value := c.QueryParam("type"); value != "" {
+			query.Types = strings.Split(value, ",")
+		}
+
+		if value := c.QueryParam("limit"); value != "" {
+			query.Limit, err = strconv.Atoi(value)
+			if err != nil || query.Limit < 1 {
+				return c.JSON(http.StatusBadRequest, JSONResponse{
+					"error": "limit must be a positive number",
+				})
+			}
+		}
+
+		events, err := control.Events(query)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, EventsResponse{
+			Events: events,
+		})
+	}
+}
@@ -1,16 +1,42 @@
 package handlers
 
 import (
+	"io/ioutil"
 	"net"
 	"net/http"
 
 	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/logger"
 
 	"github.com/labstack/echo"
 )
 
+var (
+	log = logger.New("api")
+
+	// how the server was started, apiServer changes only reach it after a restart
+	listenAddress        string
+	httpScheme, wsScheme = "http://", "ws://"
+)
+
 type JSONResponse map[string]interface{}
 
+// StatusResponse and ErrorResponse are the shapes of the plain JSONResponse acknowledgements and failures, kept for the API document
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// set when a command failed, one of the websocket error codes
+	Code string `json:"code,omitempty"`
+}
+
+type EndpointsResponse struct {
+	Camera string `json:"camera"`
+	WS     string `json:"ws"`
+}
+
 func Health() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		return c.JSON(http.StatusOK, JSONResponse{
@@ -19,17 +45,111 @@ func Health() echo.HandlerFunc {
 	}
 }
 
+type ConfigUpdateResponse struct {
+	Config  config.ConfigStruct `json:"config"`
+	Changed []string            `json:"changed"`
+	// changed keys that are saved but only take effect once the mower restarts
+	RestartRequired []string `json:"restart_required"`
+}
+
 func Config() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		return c.JSON(http.StatusOK, config.Config)
+		return c.JSON(http.StatusOK, redactConfig(config.Current()))
+	}
+}
+
+// UpdateConfig replaces the whole config, anything left out goes back to its default
+func UpdateConfig() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return updateConfig(c, config.Replace)
+	}
+}
+
+// PatchConfig changes part of the config, the body is a JSON merge patch
+func PatchConfig() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return updateConfig(c, config.Patch)
+	}
+}
+
+func updateConfig(c echo.Context, decode func(data []byte) (*config.ConfigStruct, error)) error {
+	data, err := ioutil.ReadAll(c.Request().Body)
+	if err == nil {
+		var cfg *config.ConfigStruct
+		if cfg, err = decode(data); err == nil {
+			keepCredentials(cfg)
+
+			var changed, restart []string
+			if changed, restart, err = config.Update(cfg); err == nil {
+				log.Infof("config changed %v", changed)
+
+				// the running config, with any environment and command line overrides on top of what was saved
+				return c.JSON(http.StatusOK, ConfigUpdateResponse{
+					Config:          redactConfig(config.Current()),
+					Changed:         changed,
+					RestartRequired: restart,
+				})
+			}
+		}
+	}
+
+	return c.JSON(http.StatusBadRequest, JSONResponse{
+		"error": err.Error(),
+	})
+}
+
+// redactConfig copies cfg without credentials, they never leave the mower even hashed
+func redactConfig(cfg *config.ConfigStruct) config.ConfigStruct {
+	redacted := *cfg
+
+	redacted.Auth.Users = append(redacted.Auth.Users[:0:0], redacted.Auth.Users...)
+	for i := range redacted.Auth.Users {
+		redacted.Auth.Users[i].PasswordHash = ""
+	}
+	redacted.Auth.Tokens = append(redacted.Auth.Tokens[:0:0], redacted.Auth.Tokens...)
+	for i := range redacted.Auth.Tokens {
+		redacted.Auth.Tokens[i].TokenHash = ""
+	}
+
+	return redacted
+}
+
+// keepCredentials fills in the credentials a redacted config sent back has blanked, matching users and tokens by name
+func keepCredentials(cfg *config.ConfigStruct) {
+	running := config.Current()
+
+	for i, u := range cfg.Auth.Users {
+		for _, existing := range running.Auth.Users {
+			if u.PasswordHash == "" && u.Username == existing.Username {
+				cfg.Auth.Users[i].PasswordHash = existing.PasswordHash
+			}
+		}
+	}
+
+	for i, t := range cfg.Auth.Tokens {
+		for _, existing := range running.Auth.Tokens {
+			if t.TokenHash == "" && t.Name == existing.Name {
+				cfg.Auth.Tokens[i].TokenHash = existing.TokenHash
+			}
+		}
+	}
+}
+
+// SetServer records the address and scheme the server listens on, Endpoints keeps reporting them when the saved config changes
+func SetServer(address string, tls bool) {
+	listenAddress = address
+
+	httpScheme, wsScheme = "http://", "ws://"
+	if tls {
+		httpScheme, wsScheme = "https://", "wss://"
 	}
 }
 
 func Endpoints() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		return c.JSON(http.StatusOK, JSONResponse{
-			"camera": "http://" + GetLocalIP() + config.Config.APIServer.ListenAddress + "/camera",
-			"ws":     "ws://" + GetLocalIP() + config.Config.APIServer.ListenAddress + "/ws",
+		return c.JSON(http.StatusOK, EndpointsResponse{
+			Camera: httpScheme + GetLocalIP() + listenAddress + "/camera",
+			WS:     wsScheme + GetLocalIP() + listenAddress + "/ws",
 		})
 	}
 }
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+func CurrentJob() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var job *control.JobStruct
+		control.Do(func() {
+			job = control.CurrentJob()
+		})
+
+		if job == nil {
+			return c.JSON(http.StatusNotFound, JSONResponse{
+				"error": "no job has been run",
+			})
+		}
+
+		return c.JSON(http.StatusOK, job)
+	}
+}
+
+func StartJob() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, "startJob", http.StatusCreated)
+	}
+}
+
+func JobEnergyReport() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var report *control.JobEnergyReportStruct
+		var err error
+		control.Do(func() {
+			report, err = control.JobEnergyReport(c.QueryParam("group_by"))
+		})
+
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+func PauseJob() echo.HandlerFunc {
+	return jobAction("pauseJob")
+}
+
+func ResumeJob() echo.HandlerFunc {
+	return jobAction("resumeJob")
+}
+
+func AbortJob() echo.HandlerFunc {
+	return jobAction("abortJob")
+}
+
+func jobAction(method string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return runCommand(c, method, http.StatusOK)
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/logger"
+
+	"github.com/labstack/echo"
+)
+
+// Logging returns the default level, the output format and the level of every subsystem, empty where it follows the default
+func Logging() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, logger.Settings())
+	}
+}
+
+// UpdateLogging changes only the levels and format in the body until the next restart or config change, it does not touch the config file
+func UpdateLogging() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var settings logger.SettingsStruct
+		err := c.Bind(&settings)
+		if err == nil {
+			err = logger.Update(settings)
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		log.Infof("logging changed %+v", settings)
+
+		return c.JSON(http.StatusOK, logger.Settings())
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+type RecordingsResponse struct {
+	Recordings []control.RecordingStruct `json:"recordings"`
+}
+
+func Recordings() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var recordings []control.RecordingStruct
+		var err error
+		control.Do(func() {
+			recordings, err = control.Recordings()
+		})
+
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, RecordingsResponse{
+			Recordings: recordings,
+		})
+	}
+}
+
+// Recording downloads a session for replay with mower --replay, the active session is complete up to its last state snapshot
+func Recording() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+
+		path, err := control.RecordingFile(name)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, JSONResponse{
+				"error": err.Error(),
+			})
+		}
+
+		return c.Attachment(path, name)
+	}
+}
@@ -0,0 +1,384 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchote/robot-mower/src/api/handlers"
+	"github.com/dchote/robot-mower/src/control"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	schemaRefBase  = "#/components/schemas/"
+)
+
+var (
+	openAPIDocument []byte
+	openAPIOnce     sync.Once
+
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGeneratorStruct turns Go types into OpenAPI schemas the same way encoding/json would encode them, named structs become shared components
+type schemaGeneratorStruct struct {
+	schemas map[string]interface{}
+	// describe patches, no key is required and named structs get their own ...Patch components
+	partial bool
+}
+
+// OpenAPI serves the OpenAPI document, it is built from the route table and the Go types the first time it is asked for
+func OpenAPI() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		openAPIOnce.Do(func() {
+			openAPIDocument, _ = json.MarshalIndent(buildOpenAPI(apiRoutes()), "", "  ")
+		})
+
+		return c.JSONBlob(http.StatusOK, openAPIDocument)
+	}
+}
+
+func buildOpenAPI(routes []routeStruct) map[string]interface{} {
+	g := &schemaGeneratorStruct{schemas: make(map[string]interface{})}
+	g.ref(handlers.ErrorResponse{})
+
+	paths := make(map[string]map[string]interface{})
+	addOperation := func(path string, method string, operation map[string]interface{}) {
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	for _, route := range routes {
+		if route.perCommand {
+			for _, command := range control.DescribeCommands() {
+				path := strings.Replace(route.path, ":method", command.Method, 1)
+				addOperation(path, route.method, g.commandOperation(route, command))
+			}
+			continue
+		}
+
+		path, operation := g.operation(route)
+		if route.path == "/ws" {
+			operation["x-websocket"] = g.websocketMessages()
+		}
+		addOperation(path, route.method, operation)
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "Robot Mower API",
+			"version":     "v" + strconv.Itoa(control.ProtocolVersion),
+			"description": "Each operation lists the least role it needs in x-required-role. The websocket message schemas are under x-websocket on /ws.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				// for clients that cannot set headers, such as a browser websocket
+				"tokenQuery": map[string]interface{}{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"tokenQuery": []string{}},
+		},
+	}
+}
+
+// operation documents one route and returns its path in OpenAPI form
+func (g *schemaGeneratorStruct) operation(route routeStruct) (string, map[string]interface{}) {
+	operation := map[string]interface{}{
+		"summary":     route.summary,
+		"tags":        []string{route.tag},
+		"operationId": operationID(route.method, route.path),
+	}
+
+	parameters := []interface{}{}
+	segments := strings.Split(route.path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := strings.TrimPrefix(segment, ":")
+			segments[i] = "{" + name + "}"
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	for _, name := range route.query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "query", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if route.request != nil {
+		request := g
+		if route.partial {
+			request = &schemaGeneratorStruct{schemas: g.schemas, partial: true}
+		}
+
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": request.ref(route.request)}},
+		}
+	}
+
+	status := route.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if route.path == "/ws" {
+		status = http.StatusSwitchingProtocols
+	}
+
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if route.response != nil {
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": g.ref(route.response)}}
+	} else if route.produces != "" {
+		success["content"] = map[string]interface{}{route.produces: map[string]interface{}{}}
+	}
+
+	responses := map[string]interface{}{strconv.Itoa(status): success}
+	if route.method != echo.GET {
+		responses["400"] = errorResponse(http.StatusBadRequest)
+		responses["409"] = errorResponse(http.StatusConflict)
+	} else if len(route.query) > 0 {
+		responses["400"] = errorResponse(http.StatusBadRequest)
+	}
+	if len(parameters) > len(route.query) {
+		responses["404"] = errorResponse(http.StatusNotFound)
+	}
+	g.addSecurity(operation, responses, route.role)
+	operation["responses"] = responses
+
+	return strings.Join(segments, "/"), operation
+}
+
+// commandOperation documents a single command method of the generic command route
+func (g *schemaGeneratorStruct) commandOperation(route routeStruct, command control.CommandDescription) map[string]interface{} {
+	operation := map[string]interface{}{
+		"summary":         "Run the " + command.Method + " command",
+		"tags":            []string{route.tag},
+		"operationId":     command.Method,
+		"x-needs-control": command.NeedsControl,
+	}
+
+	if command.Payload != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": g.ref(command.Payload)}},
+		}
+	}
+
+	// the result depends on the command, it is the same payload a websocket ack carries
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "the command result, or a status when it has none",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{}}},
+		},
+	}
+	for _, code := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict} {
+		responses[strconv.Itoa(code)] = errorResponse(code)
+	}
+	g.addSecurity(operation, responses, command.Role)
+	operation["responses"] = responses
+
+	return operation
+}
+
+// websocketMessages describes the websocket protocol, it has no place in OpenAPI proper so it goes in an extension
+func (g *schemaGeneratorStruct) websocketMessages() map[string]interface{} {
+	commands := make(map[string]interface{})
+	for _, command := range control.DescribeCommands() {
+		if command.Payload != nil {
+			commands[command.Method] = g.ref(command.Payload)
+		} else {
+			commands[command.Method] = map[string]interface{}{}
+		}
+	}
+
+	return map[string]interface{}{
+		"protocolVersion": control.ProtocolVersion,
+		"envelope":        g.ref(control.Envelope{}),
+		"messages": map[string]interface{}{
+			control.MessageTypeHello:       g.ref(control.HelloPayload{}),
+			control.MessageTypeWelcome:     g.ref(control.CapabilitiesStruct{}),
+			control.MessageTypeSubscribe:   g.ref(control.SubscribePayload{}),
+			control.MessageTypeUnsubscribe: g.ref(control.SubscribePayload{}),
+			control.MessageTypeError:       g.ref(control.ProtocolError{}),
+		},
+		"commands": commands,
+		"events": map[string]interface{}{
+			control.TopicProtection: g.ref(control.ProtectionEvent{}),
+			control.TopicControl:    g.ref(control.ControlEvent{}),
+			control.TopicEvents:     g.ref(control.EventStruct{}),
+		},
+		"topics": control.TopicNames(),
+		// clients that never say hello
+		"legacy": map[string]interface{}{
+			"command": g.ref(control.CommandMessage{}),
+			"state":   g.ref(control.StateMessage{}),
+			"event":   g.ref(control.EventMessage{}),
+			"error":   g.ref(control.CommandErrorMessage{}),
+		},
+	}
+}
+
+func (g *schemaGeneratorStruct) addSecurity(operation map[string]interface{}, responses map[string]interface{}, role string) {
+	if role == "" {
+		operation["security"] = []interface{}{}
+		return
+	}
+
+	operation["x-required-role"] = role
+	responses["401"] = errorResponse(http.StatusUnauthorized)
+	responses["403"] = errorResponse(http.StatusForbidden)
+}
+
+// ref returns the schema of value's type
+func (g *schemaGeneratorStruct) ref(value interface{}) map[string]interface{} {
+	return g.schema(reflect.TypeOf(value))
+}
+
+func (g *schemaGeneratorStruct) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		name := t.Name()
+		if g.partial {
+			name += "Patch"
+		}
+
+		// a placeholder first so a type that refers to itself ends instead of recursing
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = map[string]interface{}{}
+			g.schemas[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": schemaRefBase + name}
+	}
+
+	// interfaces hold anything
+	return map[string]interface{}{}
+}
+
+// object describes a struct's fields, embedded structs are flattened into it as encoding/json does
+func (g *schemaGeneratorStruct) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+
+			parts := strings.Split(tag, ",")
+			name := parts[0]
+
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+				addFields(fieldType)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = g.schema(field.Type)
+
+			omitempty := false
+			for _, option := range parts[1:] {
+				if option == "omitempty" {
+					omitempty = true
+				}
+			}
+			if !omitempty && field.Type.Kind() != reflect.Ptr && !g.partial {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		object["required"] = required
+	}
+
+	return object
+}
+
+func errorResponse(code int) map[string]interface{} {
+	return map[string]interface{}{
+		"description": http.StatusText(code),
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": schemaRefBase + "ErrorResponse"}},
+		},
+	}
+}
+
+// operationID makes a stable identifier from the method and path, such as getV1ZonesZoneCoveragePng
+func operationID(method string, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+
+	return id
+}
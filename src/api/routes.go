@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/dchote/robot-mower/src/api/handlers"
+	"github.com/dchote/robot-mower/src/auth"
+	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/control"
+	"github.com/dchote/robot-mower/src/logger"
+	"github.com/dchote/robot-mower/src/vision"
+
+	"github.com/labstack/echo"
+)
+
+// routeStruct is one API route, the same table registers the routes with echo and generates the OpenAPI document so the two cannot disagree
+type routeStruct struct {
+	method  string
+	path    string
+	handler echo.HandlerFunc
+	// the least role allowed, empty for public routes
+	role    string
+	tag     string
+	summary string
+
+	// zero values whose types describe the request body and the response, nil when there is none
+	request  interface{}
+	response interface{}
+	// the request is a patch, such as a JSON merge patch, so none of its keys are required
+	partial bool
+	// content type of a response that is not JSON
+	produces string
+	query    []string
+	// success status when it is not 200
+	status int
+	// documented once for every command method rather than as a single route
+	perCommand bool
+	// public routes that other web pages must not be able to call through a browser
+	sameOrigin bool
+}
+
+func apiRoutes() []routeStruct {
+	return []routeStruct{
+		{method: echo.GET, path: "/v1/health", handler: handlers.Health(), tag: "system",
+			summary: "Check the server is up", response: handlers.StatusResponse{}},
+		{method: echo.GET, path: "/v1/config", handler: handlers.Config(), role: auth.RoleAdmin, tag: "system",
+			summary: "Read the running configuration, credentials are left out", response: config.ConfigStruct{}},
+		{method: echo.PUT, path: "/v1/config", handler: handlers.UpdateConfig(), role: auth.RoleAdmin, tag: "system",
+			summary: "Replace the configuration, keys left out take their default and blank credentials keep their current value",
+			request: config.ConfigStruct{}, response: handlers.ConfigUpdateResponse{}},
+		{method: echo.PATCH, path: "/v1/config", handler: handlers.PatchConfig(), role: auth.RoleAdmin, tag: "system",
+			summary: "Change part of the configuration with a JSON merge patch",
+			request: config.ConfigStruct{}, partial: true, response: handlers.ConfigUpdateResponse{}},
+		{method: echo.GET, path: "/v1/logging", handler: handlers.Logging(), role: auth.RoleAdmin, tag: "system",
+			summary: "Read the log levels and format", response: logger.SettingsStruct{}},
+		{method: echo.PATCH, path: "/v1/logging", handler: handlers.UpdateLogging(), role: auth.RoleAdmin, tag: "system",
+			summary: "Change log levels or format until the next restart, an empty subsystem level follows the default level",
+			request: logger.SettingsStruct{}, partial: true, response: logger.SettingsStruct{}},
+		{method: echo.GET, path: "/v1/endpoints", handler: handlers.Endpoints(), tag: "system",
+			summary: "Camera and websocket URLs", response: handlers.EndpointsResponse{}},
+		{method: echo.GET, path: "/v1/openapi.json", handler: OpenAPI(), tag: "system",
+			summary: "This document", produces: "application/json"},
+
+		{method: echo.POST, path: "/v1/auth/login", handler: handlers.Login(), tag: "auth", sameOrigin: true,
+			summary: "Start a session", request: handlers.LoginRequest{}, response: handlers.LoginResponse{}},
+		{method: echo.POST, path: "/v1/auth/logout", handler: handlers.Logout(), role: auth.RoleViewer, tag: "auth",
+			summary: "End the session", response: handlers.StatusResponse{}},
+		{method: echo.GET, path: "/v1/auth/me", handler: handlers.Me(), role: auth.RoleViewer, tag: "auth",
+			summary: "Who the request is authenticated as", response: auth.Principal{}},
+
+		{method: echo.GET, path: "/v1/state", handler: handlers.State(), role: auth.RoleViewer, tag: "control",
+			summary: "The current mower state", response: control.MowerStateStruct{}},
+		{method: echo.GET, path: "/v1/commands", handler: handlers.Commands(), role: auth.RoleViewer, tag: "control",
+			summary: "List the command methods", response: handlers.CommandsResponse{}},
+		// commands check the caller's role themselves, emergencyStop is open to viewers
+		{method: echo.POST, path: "/v1/commands/:method", handler: handlers.Command(), role: auth.RoleViewer, tag: "control",
+			summary: "Run a command, exactly as over the websocket", perCommand: true},
+		{method: echo.PUT, path: "/v1/drive/speed", handler: handlers.SetDriveSpeed(), role: auth.RoleOperator, tag: "control",
+			summary: "Set the drive speed", request: control.SpeedPayload{}, response: handlers.StatusResponse{}},
+		{method: echo.PUT, path: "/v1/cutter/speed", handler: handlers.SetCutterSpeed(), role: auth.RoleOperator, tag: "control",
+			summary: "Set the cutter speed", request: control.SpeedPayload{}, response: handlers.StatusResponse{}},
+		{method: echo.POST, path: "/v1/estop", handler: handlers.EmergencyStop(), role: auth.RoleViewer, tag: "control",
+			summary: "Stop the blade and wheels, whoever holds control", response: handlers.StatusResponse{}},
+
+		{method: echo.GET, path: "/v1/jobs/current", handler: handlers.CurrentJob(), role: auth.RoleViewer, tag: "jobs",
+			summary: "The current or last job", response: control.JobStruct{}},
+		{method: echo.POST, path: "/v1/jobs", handler: handlers.StartJob(), role: auth.RoleOperator, tag: "jobs",
+			summary: "Start a job", request: control.JobRequest{}, response: control.JobStruct{}, status: http.StatusCreated},
+		{method: echo.GET, path: "/v1/jobs/energy", handler: handlers.JobEnergyReport(), role: auth.RoleViewer, tag: "jobs",
+			summary: "Energy used by past jobs", response: control.JobEnergyReportStruct{}, query: []string{"group_by"}},
+		{method: echo.POST, path: "/v1/jobs/current/pause", handler: handlers.PauseJob(), role: auth.RoleOperator, tag: "jobs",
+			summary: "Pause the running job", response: control.JobStruct{}},
+		{method: echo.POST, path: "/v1/jobs/current/resume", handler: handlers.ResumeJob(), role: auth.RoleOperator, tag: "jobs",
+			summary: "Resume the paused job", response: control.JobStruct{}},
+		{method: echo.POST, path: "/v1/jobs/current/abort", handler: handlers.AbortJob(), role: auth.RoleOperator, tag: "jobs",
+			summary: "Abort the current job", response: control.JobStruct{}},
+
+		{method: echo.GET, path: "/v1/zones/:zone/coverage.png", handler: handlers.CoveragePNG(), role: auth.RoleViewer, tag: "zones",
+			summary: "Coverage map image", produces: "image/png"},
+		{method: echo.GET, path: "/v1/zones/:zone/coverage.geojson", handler: handlers.CoverageGeoJSON(), role: auth.RoleViewer, tag: "zones",
+			summary: "Coverage map as GeoJSON", produces: "application/geo+json"},
+		{method: echo.GET, path: "/v1/zones/:zone/coverage/gaps", handler: handlers.CoverageGaps(), role: auth.RoleViewer, tag: "zones",
+			summary: "A job covering what was missed", response: control.JobRequest{}},
+		{method: echo.DELETE, path: "/v1/zones/:zone/coverage", handler: handlers.ResetCoverage(), role: auth.RoleOperator, tag: "zones",
+			summary: "Clear the coverage map", response: handlers.StatusResponse{}},
+
+		{method: echo.GET, path: "/v1/battery/history", handler: handlers.BatteryHistory(), role: auth.RoleViewer, tag: "battery",
+			summary: "Battery cycles, peak temperatures and health", response: control.BatteryHistoryStruct{}},
+
+		{method: echo.GET, path: "/v1/events", handler: handlers.Events(), role: auth.RoleViewer, tag: "events",
+			summary: "The event log, newest first", response: handlers.EventsResponse{},
+			query: []string{"since", "until", "severity", "type", "limit"}},
+
+		{method: echo.GET, path: "/v1/recordings", handler: handlers.Recordings(), role: auth.RoleViewer, tag: "recordings",
+			summary: "Recorded sessions of sensor readings, commands and state, oldest first", response: handlers.RecordingsResponse{}},
+		{method: echo.GET, path: "/v1/recordings/:name", handler: handlers.Recording(), role: auth.RoleViewer, tag: "recordings",
+			summary: "Download a recorded session for replay", produces: "application/gzip"},
+
+		{method: echo.GET, path: "/v1/dock", handler: handlers.Dock(), role: auth.RoleViewer, tag: "dock",
+			summary: "Dock position and status", response: handlers.DockResponse{}},
+		{method: echo.POST, path: "/v1/dock/return", handler: handlers.ReturnHome(), role: auth.RoleOperator, tag: "dock",
+			summary: "Drive back to the dock", response: control.MowerStateStruct{}.Dock},
+		{method: echo.POST, path: "/v1/dock/cancel", handler: handlers.CancelReturnHome(), role: auth.RoleOperator, tag: "dock",
+			summary: "Stop returning to the dock", response: control.MowerStateStruct{}.Dock},
+
+		{method: echo.GET, path: "/camera", handler: echo.WrapHandler(vision.Stream), role: auth.RoleViewer, tag: "camera",
+			summary: "MJPEG camera stream", produces: "multipart/x-mixed-replace"},
+		// anyone who may view can connect, the websocket checks the role again for each command
+		{method: echo.GET, path: "/ws", handler: control.WebSocketConnection, role: auth.RoleViewer, tag: "websocket",
+			summary: "Websocket for state, events and commands, see the websocket message schemas"},
+	}
+}
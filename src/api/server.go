@@ -2,15 +2,13 @@ package api
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/dchote/robot-mower/src/api/handlers"
+	"github.com/dchote/robot-mower/src/auth"
 	"github.com/dchote/robot-mower/src/config"
-
-	"github.com/dchote/robot-mower/src/control"
-	"github.com/dchote/robot-mower/src/vision"
+	"github.com/dchote/robot-mower/src/logger"
 
 	"github.com/GeertJohan/go.rice"
 	"github.com/labstack/echo"
@@ -19,6 +17,8 @@ import (
 
 var (
 	e *echo.Echo
+
+	log = logger.New("api")
 )
 
 func StartServer(cfg config.ConfigStruct, assets *rice.Box) {
@@ -31,18 +31,24 @@ func StartServer(cfg config.ConfigStruct, assets *rice.Box) {
 	e.HideBanner = true
 	e.Server.ReadTimeout = 10 * time.Second
 	e.Server.WriteTimeout = 0
+	e.TLSServer.ReadTimeout = e.Server.ReadTimeout
+	e.TLSServer.WriteTimeout = e.Server.WriteTimeout
 
 	// setup middleware
-	e.Use(middleware.Logger())
+	e.Use(logRequest)
 	e.Use(middleware.Recover())
 	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
 		Level: 5,
 	}))
 
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE},
-	}))
+	// the frontend served by the mower needs no CORS, only other origins that were explicitly allowed get it
+	if len(cfg.Auth.AllowedOrigins) > 0 {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins: cfg.Auth.AllowedOrigins,
+			AllowMethods: []string{echo.GET, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
+			AllowHeaders: []string{echo.HeaderAuthorization, echo.HeaderContentType},
+		}))
+	}
 
 	// prevent caching by client (e.g. Safari)
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -63,17 +69,92 @@ func StartServer(cfg config.ConfigStruct, assets *rice.Box) {
 	}
 
 	// setup API routes
-	e.GET("/v1/health", handlers.Health())
-	e.GET("/v1/config", handlers.Config())
-	e.GET("/v1/endpoints", handlers.Endpoints())
+	for _, route := range apiRoutes() {
+		var middleware []echo.MiddlewareFunc
+		if route.role != "" {
+			middleware = append(middleware, requireRole(route.role))
+		} else if route.sameOrigin {
+			middleware = append(middleware, checkOrigin)
+		}
+
+		e.Add(route.method, route.path, route.handler, middleware...)
+	}
 
-	e.GET("/camera", echo.WrapHandler(vision.Stream))
-	e.GET("/ws", control.WebSocketConnection)
+	handlers.SetServer(cfg.APIServer.ListenAddress, cfg.APIServer.TLS.Enabled)
 
-	log.Println("starting server on ", cfg.APIServer.ListenAddress)
+	if cfg.APIServer.TLS.Enabled {
+		certFile, keyFile, err := tlsFiles(cfg)
+		if err != nil {
+			log.Fatalf("unable to set up TLS: %v", err)
+		}
+
+		log.Infof("starting TLS server on %v", cfg.APIServer.ListenAddress)
+		e.StartTLS(cfg.APIServer.ListenAddress, certFile, keyFile)
+		return
+	}
+
+	log.Infof("starting server on %v", cfg.APIServer.ListenAddress)
 	e.Start(cfg.APIServer.ListenAddress)
 }
 
+// logRequest logs every request at debug and failed ones at warn, the path is logged rather than the uri as websocket and camera clients carry their token in the query
+func logRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		request := log.With("method", c.Request().Method, "path", c.Request().URL.Path, "status", status,
+			"latency", time.Since(start).Round(time.Microsecond), "remote", c.RealIP())
+		if status >= http.StatusInternalServerError {
+			request.Warnf("request failed")
+		} else {
+			request.Debugf("request")
+		}
+
+		return err
+	}
+}
+
+// requireRole rejects requests from disallowed origins or without at least role, the principal is left on the context for handlers
+func requireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return checkOrigin(func(c echo.Context) error {
+			principal, err := auth.Authenticate(c.Request())
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, handlers.JSONResponse{
+					"error": err.Error(),
+				})
+			}
+			if !auth.RoleAllows(principal.Role, role) {
+				return c.JSON(http.StatusForbidden, handlers.JSONResponse{
+					"error": role + " role required",
+				})
+			}
+
+			c.Set(auth.ContextKey, principal)
+			return next(c)
+		})
+	}
+}
+
+// checkOrigin stops other web pages from using a browser that can reach the mower
+func checkOrigin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !auth.OriginAllowed(c.Request()) {
+			return c.JSON(http.StatusForbidden, handlers.JSONResponse{
+				"error": "origin " + c.Request().Header.Get(echo.HeaderOrigin) + " is not allowed",
+			})
+		}
+
+		return next(c)
+	}
+}
+
 func StopServer() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
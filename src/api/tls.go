@@ -0,0 +1,124 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	tlsDirectory = "tls"
+
+	// long enough that nobody has to trust a new certificate every season
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// tlsFiles returns the certificate and key to serve, generating a self signed pair on first boot when neither exists yet
+func tlsFiles(cfg config.ConfigStruct) (string, string, error) {
+	certFile := cfg.APIServer.TLS.CertFile
+	if certFile == "" {
+		certFile = filepath.Join(cfg.Mower.DataDirectory, tlsDirectory, "cert.pem")
+	}
+	keyFile := cfg.APIServer.TLS.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(cfg.Mower.DataDirectory, tlsDirectory, "key.pem")
+	}
+
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return certFile, keyFile, nil
+	}
+	if certErr == nil || keyErr == nil {
+		// never overwrite half of a pair someone put there on purpose
+		return "", "", errors.New("only one of " + certFile + " and " + keyFile + " exists")
+	}
+
+	log.Infof("generating self signed certificate %v", certFile)
+	return certFile, keyFile, generateCertificate(cfg, certFile, keyFile)
+}
+
+func generateCertificate(cfg config.ConfigStruct, certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cfg.Mower.Name, Organization: []string{"Robot Mower"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range certificateHosts(cfg) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certificateHosts is every name and address the mower is likely to be reached by, plus any configured ones
+func certificateHosts(cfg config.ConfigStruct) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname, hostname+".local")
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addrs {
+			if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+
+	return append(hosts, cfg.APIServer.TLS.Hosts...)
+}
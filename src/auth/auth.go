@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/logger"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+
+	// ContextKey is where the authenticated Principal is kept on the echo context
+	ContextKey = "principal"
+
+	defaultSessionTimeout = 12 * time.Hour
+
+	// only readable by the user the mower runs as
+	bootstrapPasswordFile = "admin-password"
+)
+
+var (
+	log = logger.New("auth")
+
+	// each role may do everything the roles below it can
+	roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+	ErrUnauthorized = errors.New("authentication required")
+	ErrBadLogin     = errors.New("invalid username or password")
+
+	users    []userStruct
+	tokens   []tokenStruct
+	sessions = make(map[string]*sessionStruct)
+	lock     sync.Mutex
+)
+
+// Principal is whoever a request was authenticated as
+type Principal struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// session or token
+	Method    string     `json:"method"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type userStruct struct {
+	username     string
+	passwordHash []byte
+	role         string
+}
+
+// tokenStruct is a long lived API token, only the sha256 of the token is kept in the config
+type tokenStruct struct {
+	name string
+	hash []byte
+	role string
+}
+
+type sessionStruct struct {
+	principal Principal
+	expiresAt time.Time
+}
+
+// Init loads users and API tokens from the config, when auth is enabled without any an admin password is kept in the data directory
+func Init() error {
+	cfg := config.Current()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	users = nil
+	tokens = nil
+
+	for _, u := range cfg.Auth.Users {
+		if _, ok := roleRank[u.Role]; !ok {
+			return errors.New("user " + u.Username + " has unknown role " + u.Role)
+		}
+		users = append(users, userStruct{username: u.Username, passwordHash: []byte(u.PasswordHash), role: u.Role})
+	}
+
+	for _, t := range cfg.Auth.Tokens {
+		if _, ok := roleRank[t.Role]; !ok {
+			return errors.New("token " + t.Name + " has unknown role " + t.Role)
+		}
+		hash, err := hex.DecodeString(t.TokenHash)
+		if err != nil || len(hash) != sha256.Size {
+			return errors.New("token " + t.Name + " must have a hex encoded sha256 tokenHash")
+		}
+		tokens = append(tokens, tokenStruct{name: t.Name, hash: hash, role: t.Role})
+	}
+
+	if !cfg.Auth.Enabled {
+		log.Warnf("authentication is disabled, every client has full access")
+		return nil
+	}
+
+	if len(users) == 0 && len(tokens) == 0 {
+		password, err := bootstrapPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		users = append(users, userStruct{username: "admin", passwordHash: hash, role: RoleAdmin})
+
+		log.Warnf("no users are configured, log in as admin with the password in %v until one is added", bootstrapPasswordPath())
+	} else if err := os.Remove(bootstrapPasswordPath()); err == nil {
+		log.Infof("users are configured, removed %v", bootstrapPasswordPath())
+	}
+
+	// sessions of users that were removed or given another role end now rather than when they expire
+	for key, session := range sessions {
+		kept := false
+		for _, u := range users {
+			if u.username == session.principal.Name && u.role == session.principal.Role {
+				kept = true
+			}
+		}
+		if !kept {
+			delete(sessions, key)
+		}
+	}
+
+	return nil
+}
+
+// Login checks a username and password and starts a session, the returned token is sent as a bearer token
+func Login(username string, password string) (string, *Principal, error) {
+	lock.Lock()
+	var user *userStruct
+	for i := range users {
+		if users[i].username == username {
+			user = &users[i]
+			break
+		}
+	}
+	lock.Unlock()
+
+	if user == nil || bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+		// slow down guessing
+		time.Sleep(time.Second)
+		return "", nil, ErrBadLogin
+	}
+
+	expiresAt := time.Now().Add(sessionTimeout())
+	session := &sessionStruct{
+		principal: Principal{Name: user.username, Role: user.role, Method: "session", ExpiresAt: &expiresAt},
+		expiresAt: expiresAt,
+	}
+
+	token := randomToken(32)
+
+	lock.Lock()
+	// expired sessions are otherwise only dropped when they are next used
+	for key, s := range sessions {
+		if time.Now().After(s.expiresAt) {
+			delete(sessions, key)
+		}
+	}
+	sessions[sessionKey(token)] = session
+	lock.Unlock()
+
+	log.Infof("%v logged in as %v", user.username, user.role)
+
+	principal := session.principal
+	return token, &principal, nil
+}
+
+// Logout ends the session the token belongs to
+func Logout(token string) {
+	lock.Lock()
+	delete(sessions, sessionKey(token))
+	lock.Unlock()
+}
+
+// Authenticate works out who sent a request from its bearer token, or the token query parameter for clients that cannot set headers such as a browser websocket
+func Authenticate(r *http.Request) (*Principal, error) {
+	if !config.Current().Auth.Enabled {
+		return &Principal{Name: "anonymous", Role: RoleAdmin, Method: "none"}, nil
+	}
+
+	token := RequestToken(r)
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := sessionKey(token)
+	if session, ok := sessions[key]; ok {
+		if time.Now().After(session.expiresAt) {
+			delete(sessions, key)
+			return nil, errors.New("session has expired")
+		}
+
+		principal := session.principal
+		return &principal, nil
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash) == 1 {
+			return &Principal{Name: t.name, Role: t.role, Method: "token"}, nil
+		}
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// RequestToken returns the token a request carries, empty if it has none
+func RequestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// RoleAllows reports whether role has at least the access of required
+func RoleAllows(role string, required string) bool {
+	return roleRank[role] >= roleRank[required]
+}
+
+// OriginAllowed accepts requests without an Origin (anything that is not a browser), from the page the server itself serves, or from an allowed origin
+func OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+
+	for _, allowed := range config.Current().Auth.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sessions are keyed by a hash of their token so the map never holds a usable token
+func sessionKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// bootstrapPassword reads the admin password used while no users are configured, generating it the first time so it stays the same across restarts
+func bootstrapPassword() (string, error) {
+	path := bootstrapPasswordPath()
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	password := randomToken(12)
+	if err := ioutil.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		return "", err
+	}
+	// WriteFile leaves the mode of a file that was already there alone
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+func bootstrapPasswordPath() string {
+	return filepath.Join(config.Current().Mower.DataDirectory, bootstrapPasswordFile)
+}
+
+func randomToken(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func sessionTimeout() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Auth.SessionTimeout > 0 {
+		return time.Duration(cfg.Auth.SessionTimeout) * time.Minute
+	}
+
+	return defaultSessionTimeout
+}
@@ -1,39 +1,161 @@
 package config
 
 import (
-	"encoding/json"
-	"fmt"
-	"os"
+	"sync/atomic"
 )
 
 type ConfigStruct struct {
 	APIServer struct {
 		ListenAddress string `json:"listenAddress"`
+		TLS           struct {
+			Enabled bool `json:"enabled"`
+			// a self signed pair is generated in the data directory when these are left empty
+			CertFile string `json:"certFile"`
+			KeyFile  string `json:"keyFile"`
+			// extra names and addresses the generated certificate should be valid for
+			Hosts []string `json:"hosts"`
+		} `json:"tls"`
 	} `json:"apiServer"`
+	Auth struct {
+		Enabled bool `json:"enabled"`
+		// minutes
+		SessionTimeout int `json:"sessionTimeout"`
+		// browser origins other than the mower itself that may call the API, "*" allows any
+		AllowedOrigins []string `json:"allowedOrigins"`
+		Users          []struct {
+			Username string `json:"username"`
+			// bcrypt
+			PasswordHash string `json:"passwordHash"`
+			Role         string `json:"role"`
+		} `json:"users"`
+		Tokens []struct {
+			Name string `json:"name"`
+			// hex encoded sha256 of the token
+			TokenHash string `json:"tokenHash"`
+			Role      string `json:"role"`
+		} `json:"tokens"`
+	} `json:"auth"`
 	Mower struct {
-		Name           string `json:"name"`
-		CameraDeviceID int    `json:"cameraDeviceID"`
-	} `json:mower`
+		Name           string  `json:"name"`
+		CameraDeviceID int     `json:"cameraDeviceID"`
+		DataDirectory  string  `json:"dataDirectory"`
+		CutterWidth    float64 `json:"cutterWidth"`
+	} `json:"mower"`
+	Navigation struct {
+		LookaheadDistance  float64 `json:"lookaheadDistance"`
+		WaypointTolerance  float64 `json:"waypointTolerance"`
+		GoalTolerance      float64 `json:"goalTolerance"`
+		MaxLinearVelocity  float64 `json:"maxLinearVelocity"`
+		MaxAngularVelocity float64 `json:"maxAngularVelocity"`
+	} `json:"navigation"`
+	Control struct {
+		LeaseTimeout  int  `json:"leaseTimeout"`
+		AllowTakeover bool `json:"allowTakeover"`
+		// ms between full state pushes to websocket clients
+		PublishInterval int `json:"publishInterval"`
+	} `json:"control"`
+	Drive struct {
+		LinearAcceleration  float64 `json:"linearAcceleration"`
+		AngularAcceleration float64 `json:"angularAcceleration"`
+		CommandTimeout      int     `json:"commandTimeout"`
+	} `json:"drive"`
+	Coverage struct {
+		CellSize float64 `json:"cellSize"`
+	} `json:"coverage"`
+	Dock struct {
+		X                float64 `json:"x"`
+		Y                float64 `json:"y"`
+		Heading          float64 `json:"heading"`
+		ApproachDistance float64 `json:"approachDistance"`
+		AlignTolerance   float64 `json:"alignTolerance"`
+		CreepVelocity    float64 `json:"creepVelocity"`
+		ChargingCurrent  float64 `json:"chargingCurrent"`
+	} `json:"dock"`
+	PowerMonitors []struct {
+		Name            string  `json:"name"`
+		Bus             int     `json:"bus"`
+		Address         int     `json:"address"`
+		ShuntResistance float64 `json:"shuntResistance"`
+		MaxCurrent      float64 `json:"maxCurrent"`
+		Gain            int     `json:"gain"`
+		Averaging       int     `json:"averaging"`
+	} `json:"powerMonitors"`
+	Battery struct {
+		Monitor             string  `json:"monitor"`
+		VoltageNominal      float64 `json:"voltageNominal"`
+		VoltageWarn         float64 `json:"voltageWarn"`
+		ResumeVoltage       float64 `json:"resumeVoltage"`
+		ResumeStateOfCharge float64 `json:"resumeStateOfCharge"`
+		ReserveMinutes      float64 `json:"reserveMinutes"`
+		HistoryWindow       int     `json:"historyWindow"`
+
+		Chemistry   string       `json:"chemistry"`
+		Cells       int          `json:"cells"`
+		Capacity    float64      `json:"capacity"`
+		OCVCurve    [][2]float64 `json:"ocvCurve"`
+		RestCurrent float64      `json:"restCurrent"`
+		RestTime    int          `json:"restTime"`
+
+		// an optional NTC thermistor on the pack, read through an ADS1115 input as the lower half of a divider
+		Temperature struct {
+			Enabled           bool    `json:"enabled"`
+			Bus               int     `json:"bus"`
+			Address           int     `json:"address"`
+			Channel           int     `json:"channel"`
+			SupplyVoltage     float64 `json:"supplyVoltage"`
+			SeriesResistance  float64 `json:"seriesResistance"`
+			NominalResistance float64 `json:"nominalResistance"`
+			Beta              float64 `json:"beta"`
+		} `json:"temperature"`
+	} `json:"battery"`
+	Energy struct {
+		DriveMonitor  string `json:"driveMonitor"`
+		CutterMonitor string `json:"cutterMonitor"`
+	} `json:"energy"`
+	Protection struct {
+		Rules []struct {
+			Name       string  `json:"name"`
+			Monitor    string  `json:"monitor"`
+			Type       string  `json:"type"`
+			Hysteresis float64 `json:"hysteresis"`
+			Levels     []struct {
+				Level     string  `json:"level"`
+				Threshold float64 `json:"threshold"`
+				Duration  float64 `json:"duration"`
+			} `json:"levels"`
+		} `json:"rules"`
+	} `json:"protection"`
+	Events struct {
+		// KB a log file may grow to before it is rotated
+		MaxFileSize int `json:"maxFileSize"`
+		// files kept, including the current one
+		MaxFiles int `json:"maxFiles"`
+	} `json:"events"`
+	Logging struct {
+		// debug, info, warn or error
+		Level string `json:"level"`
+		// text or json
+		Format string `json:"format"`
+		// levels for single subsystems, eg. {"control": "debug"}, the rest follow level
+		Subsystems map[string]string `json:"subsystems"`
+	} `json:"logging"`
+	Recorder struct {
+		// sensor readings, commands and state snapshots written to mower.dataDirectory/recordings for replay
+		Enabled bool `json:"enabled"`
+		// sessions kept, the oldest are removed as new ones start
+		MaxSessions int `json:"maxSessions"`
+	} `json:"recorder"`
 }
 
 var (
 	ConfigFile string
-	Config     *ConfigStruct
-)
-
-func LoadConfig(file string) error {
-	var cfg ConfigStruct
 
-	configFile, err := os.Open(file)
-	defer configFile.Close()
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-
-	jsonParser := json.NewDecoder(configFile)
-	err = jsonParser.Decode(&cfg)
-
-	Config = &cfg
+	// the running *ConfigStruct, replaced whole on every change and never modified once published
+	current atomic.Value
+)
 
-	return err
+// Current returns the running config, take it once and read everything from that copy so a reload part way through cannot mix two configs, it must not be modified
+func Current() *ConfigStruct {
+	cfg, _ := current.Load().(*ConfigStruct)
+	return cfg
 }
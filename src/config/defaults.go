@@ -0,0 +1,123 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+const (
+	// one INA219 on the battery at the chip's default address
+	defaultPowerMonitors = `[
+		{"name": "battery", "bus": 1, "address": 64, "shuntResistance": 0.1, "maxCurrent": 3.2, "gain": 0, "averaging": 1}
+	]`
+
+	// staged undervoltage, overcurrent and spike protection on the battery monitor for a 6 cell lipo pack
+	defaultProtectionRules = `[
+		{"name": "batteryUndervoltage", "monitor": "battery", "type": "undervoltage", "hysteresis": 0.5, "levels": [
+			{"level": "warning", "threshold": 21.0, "duration": 5},
+			{"level": "cutter", "threshold": 20.4, "duration": 5},
+			{"level": "stop", "threshold": 19.8, "duration": 2}
+		]},
+		{"name": "batteryOvercurrent", "monitor": "battery", "type": "overcurrent", "hysteresis": 0.3, "levels": [
+			{"level": "warning", "threshold": 2.6, "duration": 5},
+			{"level": "cutter", "threshold": 2.9, "duration": 3},
+			{"level": "stop", "threshold": 3.1, "duration": 1}
+		]},
+		{"name": "batteryCurrentSpike", "monitor": "battery", "type": "spike", "hysteresis": 0.5, "levels": [
+			{"level": "cutter", "threshold": 1.5, "duration": 0}
+		]}
+	]`
+)
+
+// Defaults returns the value of every key that the config file, environment and command line leave out
+func Defaults() *ConfigStruct {
+	var cfg ConfigStruct
+
+	cfg.APIServer.ListenAddress = ":8088"
+	// plain HTTP, with TLS enabled and no files a self signed pair is generated in mower.dataDirectory/tls
+	cfg.APIServer.TLS.Enabled = false
+
+	// logins required, with no users an admin password is generated once into mower.dataDirectory/admin-password
+	cfg.Auth.Enabled = true
+	// minutes, 12 hours
+	cfg.Auth.SessionTimeout = 720
+	// only the mower's own pages, and no users or tokens
+
+	cfg.Mower.Name = "MowPi"
+	cfg.Mower.CameraDeviceID = 0
+	cfg.Mower.DataDirectory = "./data"
+	// metres
+	cfg.Mower.CutterWidth = 0.3
+
+	// metres and metres per second, radians per second for the angular velocity
+	cfg.Navigation.LookaheadDistance = 0.5
+	cfg.Navigation.WaypointTolerance = 0.25
+	cfg.Navigation.GoalTolerance = 0.1
+	cfg.Navigation.MaxLinearVelocity = 0.5
+	cfg.Navigation.MaxAngularVelocity = 1.0
+
+	// seconds without a command before an idle controller loses the lease
+	cfg.Control.LeaseTimeout = 30
+	cfg.Control.AllowTakeover = true
+	// ms
+	cfg.Control.PublishInterval = 1000
+
+	// speed units per second, and ms without a drive command before the wheels are stopped
+	cfg.Drive.LinearAcceleration = 1.0
+	cfg.Drive.AngularAcceleration = 2.0
+	cfg.Drive.CommandTimeout = 500
+
+	// metres
+	cfg.Coverage.CellSize = 0.1
+
+	// the dock sits at the origin facing along x, distances in metres, current in amps
+	cfg.Dock.ApproachDistance = 1.0
+	cfg.Dock.AlignTolerance = 0.05
+	cfg.Dock.CreepVelocity = 0.1
+	cfg.Dock.ChargingCurrent = 0.1
+
+	json.Unmarshal([]byte(defaultPowerMonitors), &cfg.PowerMonitors)
+
+	// volts, resume a job cut short by a low battery at 90% charge
+	cfg.Battery.Monitor = "battery"
+	cfg.Battery.VoltageNominal = 24.0
+	cfg.Battery.VoltageWarn = 22.0
+	cfg.Battery.ResumeVoltage = 24.5
+	cfg.Battery.ResumeStateOfCharge = 90
+	// minutes of runtime kept in hand for the trip home, and seconds of voltage history behind the runtime prediction
+	cfg.Battery.ReserveMinutes = 5
+	cfg.Battery.HistoryWindow = 300
+	// a 5Ah 6S lipo pack using the built in lipo curve, at rest below 50mA for 60 seconds
+	cfg.Battery.Chemistry = "lipo"
+	cfg.Battery.Cells = 6
+	cfg.Battery.Capacity = 5.0
+	cfg.Battery.RestCurrent = 0.05
+	cfg.Battery.RestTime = 60
+	// no thermistor fitted, when there is one it is a 10k 3950 NTC under a 10k resistor from 3.3V on input 0 of an ADS1115 at 0x48
+	cfg.Battery.Temperature.Enabled = false
+	cfg.Battery.Temperature.Bus = 1
+	cfg.Battery.Temperature.Address = 0x48
+	cfg.Battery.Temperature.Channel = 0
+	cfg.Battery.Temperature.SupplyVoltage = 3.3
+	cfg.Battery.Temperature.SeriesResistance = 10000
+	cfg.Battery.Temperature.NominalResistance = 10000
+	cfg.Battery.Temperature.Beta = 3950
+
+	// no separate drive or cutter monitors, their energy is not broken out
+
+	json.Unmarshal([]byte(defaultProtectionRules), &cfg.Protection.Rules)
+
+	// up to 5MB of events in the data directory
+	cfg.Events.MaxFileSize = 1024
+	cfg.Events.MaxFiles = 5
+
+	// info and up from every subsystem as plain text
+	cfg.Logging.Level = "info"
+	cfg.Logging.Format = "text"
+	cfg.Logging.Subsystems = map[string]string{}
+
+	// a recording of every run, the last 20 kept
+	cfg.Recorder.Enabled = true
+	cfg.Recorder.MaxSessions = 20
+
+	return &cfg
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// environment variables named MOWER_ followed by the key in upper snake case override the file, eg. MOWER_API_SERVER_LISTEN_ADDRESS
+	envPrefix = "MOWER_"
+)
+
+var (
+	// key=value overrides from the command line, they win over the file and the environment every time the config is read
+	Overrides []string
+)
+
+// LoadConfig reads file with the environment and overrides on top of it and makes it the running config
+func LoadConfig(file string, overrides []string) error {
+	ConfigFile = file
+	Overrides = overrides
+
+	cfg, err := ReadConfig(file)
+	if err != nil {
+		return err
+	}
+
+	current.Store(cfg)
+
+	return nil
+}
+
+// ReadConfig builds a config from the defaults, then file, then MOWER_ environment variables, then Overrides, and validates the result
+func ReadConfig(file string) (*ConfigStruct, error) {
+	values, err := toMap(Defaults())
+	if err != nil {
+		return nil, err
+	}
+
+	fileValues, err := readFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	mergePatch(values, fileValues)
+
+	return withOverrides(values, file)
+}
+
+// withOverrides puts the MOWER_ environment variables and then Overrides on top of values and validates the result, source names where values came from in errors
+func withOverrides(values map[string]interface{}, source string) (*ConfigStruct, error) {
+	keys := configKeys()
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		if value, ok := os.LookupEnv(EnvName(key)); ok {
+			if err := setKey(values, key, value); err != nil {
+				return nil, fmt.Errorf("%v: %v", EnvName(key), err)
+			}
+		}
+	}
+
+	for _, override := range Overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("override %q must be key=value", override)
+		}
+		if err := setKey(values, parts[0], parts[1]); err != nil {
+			return nil, fmt.Errorf("override %q: %v", override, err)
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", source, err)
+	}
+	if err := Validate(cfg); err != nil {
+		return nil, fmt.Errorf("%v: %v", source, err)
+	}
+
+	return cfg, nil
+}
+
+// EnvName is the environment variable that overrides a dotted config key
+func EnvName(key string) string {
+	var name []rune
+	for _, part := range strings.Split(key, ".") {
+		runes := []rune(part)
+		for i, r := range runes {
+			// a word starts at an upper case letter after a lower case one, or at the last letter of an acronym followed by lower case
+			if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				name = append(name, '_')
+			}
+			name = append(name, unicode.ToUpper(r))
+		}
+		name = append(name, '_')
+	}
+
+	return envPrefix + strings.TrimSuffix(string(name), "_")
+}
+
+// readFile parses a json, yaml or toml file, picked by its extension, into plain maps and lists
+func readFile(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, errors.New("config file not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+
+	switch fileFormat(file) {
+	case "yaml":
+		err = yaml.Unmarshal(data, &values)
+	case "toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = json.Unmarshal(data, &values)
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line, column := position(data, syntaxErr.Offset)
+			err = fmt.Errorf("line %v column %v: %v", line, column, syntaxErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	return values, nil
+}
+
+func fileFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// encode writes cfg in the format of file, keeping whatever the user chose
+func encode(cfg *ConfigStruct, file string) ([]byte, error) {
+	format := fileFormat(file)
+	if format == "json" {
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		return append(data, '\n'), err
+	}
+
+	values, err := toMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "yaml" {
+		return yaml.Marshal(plainValue(values))
+	}
+
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(plainValue(values))
+
+	return buf.Bytes(), err
+}
+
+// plainValue drops nulls, which toml cannot hold, and turns whole numbers back into integers so int keys do not come out as 1.0
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if item != nil {
+				m[key] = plainValue(item)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			l = append(l, plainValue(item))
+		}
+		return l
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return int64(v)
+		}
+	}
+
+	return value
+}
+
+// setKey sets a dotted key in values, strings are taken as they are and anything else is parsed as JSON
+func setKey(values map[string]interface{}, key string, value string) error {
+	t, ok := configKeys()[key]
+	if !ok {
+		return fmt.Errorf("unknown key %v", key)
+	}
+
+	var parsed interface{} = value
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		// a comma separated list is easier to write in a shell than JSON
+		var list []interface{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		parsed = list
+	} else if t.Kind() != reflect.String {
+		if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+			return fmt.Errorf("%v: %q is not a valid %v", key, value, describeType(t))
+		}
+	}
+
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := values[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			values[part] = next
+		}
+		values = next
+	}
+	values[parts[len(parts)-1]] = parsed
+
+	return nil
+}
+
+// configKeys maps every dotted key to the type it holds, lists are one key and their items cannot be set on their own
+func configKeys() map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+
+			field := t.Field(i).Type
+			keys[prefix+name] = field
+			if field.Kind() == reflect.Struct {
+				walk(prefix+name+".", field)
+			}
+		}
+	}
+	walk("", reflect.TypeOf(ConfigStruct{}))
+
+	return keys
+}
+
+// unknownKeys lists the keys in value that t has no field for, including inside lists of objects
+func unknownKeys(prefix string, value interface{}, t reflect.Type) []string {
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		var unknown []string
+		for i, item := range items {
+			unknown = append(unknown, unknownKeys(prefix+strconv.Itoa(i)+".", item, t.Elem())...)
+		}
+		return unknown
+	}
+
+	values, ok := value.(map[string]interface{})
+	if !ok || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonName(t.Field(i)); name != "" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+
+	var unknown []string
+	for key, item := range values {
+		field, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		unknown = append(unknown, unknownKeys(prefix+key+".", item, field)...)
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" || field.PkgPath != "" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "whole number"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	default:
+		return "object"
+	}
+}
+
+// position turns a byte offset into a line and column for error messages
+func position(data []byte, offset int64) (line int, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n') - 1
+
+	return line, column
+}
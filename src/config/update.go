@@ -0,0 +1,386 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dchote/robot-mower/src/logger"
+)
+
+var (
+	// keys that are only read at startup, a change to them or anything below them is saved but needs a restart
+	restartKeys = []string{
+		"apiServer",
+		"auth.allowedOrigins",
+		"mower.cameraDeviceID",
+		"mower.dataDirectory",
+		"powerMonitors",
+		"battery.chemistry",
+		"battery.cells",
+		"battery.capacity",
+		"battery.ocvCurve",
+		"battery.restCurrent",
+		"battery.restTime",
+		"battery.temperature",
+	}
+
+	changeHandlers []func(old *ConfigStruct, cfg *ConfigStruct)
+
+	// serializes updates so two writers never interleave
+	updateLock sync.Mutex
+)
+
+// OnChange registers fn to be called after a new config has been applied with the previous config and the one now running, it must be called before the config can change
+func OnChange(fn func(old *ConfigStruct, cfg *ConfigStruct)) {
+	changeHandlers = append(changeHandlers, fn)
+}
+
+// Decode reads a complete config, keys that do not exist are an error rather than silently ignored
+func Decode(data []byte) (*ConfigStruct, error) {
+	var cfg ConfigStruct
+
+	var values interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	if unknown := unknownKeys("", values, reflect.TypeOf(cfg)); len(unknown) > 0 {
+		return nil, errors.New("unknown key " + strings.Join(unknown, ", "))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+			return nil, fmt.Errorf("%v must be a %v, not a %v", typeErr.Field, describeType(typeErr.Type), typeErr.Value)
+		}
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Replace reads a config to save in place of the config file, keys it leaves out take their default rather than zero
+func Replace(data []byte) (*ConfigStruct, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	return overDefaults(values)
+}
+
+// Patch applies a JSON merge patch to the contents of the config file and returns the result, the environment and overrides are left out so they are never saved
+func Patch(patch []byte) (*ConfigStruct, error) {
+	var changes map[string]interface{}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, err
+	}
+
+	values, err := readFile(ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ConfigFile, err)
+	}
+
+	return overDefaults(mergePatch(values, changes))
+}
+
+// overDefaults decodes values with the defaults filling in whatever they leave out
+func overDefaults(values map[string]interface{}) (*ConfigStruct, error) {
+	defaults, err := toMap(Defaults())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(mergePatch(defaults, values))
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(data)
+}
+
+// Validate checks a config for values the mower cannot run with, every problem is listed in the error
+func Validate(cfg *ConfigStruct) error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	_, _, err := net.SplitHostPort(cfg.APIServer.ListenAddress)
+	check(err == nil, "apiServer.listenAddress must be host:port")
+	check((cfg.APIServer.TLS.CertFile == "") == (cfg.APIServer.TLS.KeyFile == ""), "apiServer.tls certFile and keyFile must be set together")
+
+	roles := map[string]bool{"viewer": true, "operator": true, "admin": true}
+	check(cfg.Auth.SessionTimeout >= 0, "auth.sessionTimeout must not be negative")
+	for _, u := range cfg.Auth.Users {
+		check(u.Username != "", "auth.users need a username")
+		check(roles[u.Role], "auth.users "+u.Username+" role must be viewer, operator or admin")
+	}
+	for _, t := range cfg.Auth.Tokens {
+		check(t.Name != "", "auth.tokens need a name")
+		check(roles[t.Role], "auth.tokens "+t.Name+" role must be viewer, operator or admin")
+		hash, err := hex.DecodeString(t.TokenHash)
+		check(err == nil && len(hash) == 32, "auth.tokens "+t.Name+" tokenHash must be a hex encoded sha256")
+	}
+
+	check(cfg.Mower.DataDirectory != "", "mower.dataDirectory must be set")
+	check(cfg.Mower.CutterWidth >= 0, "mower.cutterWidth must not be negative")
+
+	nav := cfg.Navigation
+	check(nav.LookaheadDistance >= 0 && nav.WaypointTolerance >= 0 && nav.GoalTolerance >= 0,
+		"navigation distances must not be negative")
+	check(nav.MaxLinearVelocity >= 0 && nav.MaxAngularVelocity >= 0, "navigation velocities must not be negative")
+
+	check(cfg.Control.LeaseTimeout >= 0, "control.leaseTimeout must not be negative")
+	check(cfg.Control.PublishInterval == 0 || cfg.Control.PublishInterval >= 100, "control.publishInterval must be at least 100ms")
+	check(cfg.Drive.LinearAcceleration >= 0 && cfg.Drive.AngularAcceleration >= 0, "drive accelerations must not be negative")
+	check(cfg.Drive.CommandTimeout >= 0, "drive.commandTimeout must not be negative")
+	check(cfg.Coverage.CellSize >= 0, "coverage.cellSize must not be negative")
+
+	gains := map[int]bool{0: true, 40: true, 80: true, 160: true, 320: true}
+	monitors := map[string]bool{}
+	for _, m := range cfg.PowerMonitors {
+		check(m.Name != "" && !monitors[m.Name], "powerMonitors need a unique name")
+		check(m.ShuntResistance > 0, "powerMonitors "+m.Name+" shuntResistance must be positive")
+		check(gains[m.Gain], "powerMonitors "+m.Name+" gain must be 0, 40, 80, 160 or 320")
+		monitors[m.Name] = true
+	}
+	// with no monitors declared the controller falls back to a single battery monitor
+	if len(cfg.PowerMonitors) == 0 {
+		monitors["battery"] = true
+	}
+	knownMonitor := func(name string) bool {
+		return name == "" || monitors[name]
+	}
+	check(knownMonitor(cfg.Battery.Monitor), "battery.monitor "+cfg.Battery.Monitor+" is not a power monitor")
+	check(knownMonitor(cfg.Energy.DriveMonitor), "energy.driveMonitor "+cfg.Energy.DriveMonitor+" is not a power monitor")
+	check(knownMonitor(cfg.Energy.CutterMonitor), "energy.cutterMonitor "+cfg.Energy.CutterMonitor+" is not a power monitor")
+
+	check(cfg.Battery.Cells >= 0 && cfg.Battery.Capacity >= 0, "battery cells and capacity must not be negative")
+	check(cfg.Battery.ResumeStateOfCharge >= 0 && cfg.Battery.ResumeStateOfCharge <= 100, "battery.resumeStateOfCharge must be between 0 and 100")
+	chemistries := map[string]bool{"": true, "lipo": true, "liion": true, "li-ion": true}
+	check(chemistries[strings.ToLower(cfg.Battery.Chemistry)], "battery.chemistry must be lipo or liion")
+	curveOK := true
+	for _, p := range cfg.Battery.OCVCurve {
+		curveOK = curveOK && p[0] > 0 && p[1] >= 0 && p[1] <= 100
+	}
+	check(curveOK, "battery.ocvCurve points must be [cell volts, percent charge]")
+	if t := cfg.Battery.Temperature; t.Enabled {
+		check(t.Channel >= 0 && t.Channel <= 3, "battery.temperature.channel must be 0 to 3")
+		check(t.SupplyVoltage > 0 && t.SeriesResistance > 0 && t.NominalResistance > 0 && t.Beta > 0,
+			"battery.temperature supplyVoltage, seriesResistance, nominalResistance and beta must be more than 0")
+	}
+
+	ruleTypes := map[string]bool{"undervoltage": true, "overcurrent": true, "spike": true}
+	levels := map[string]bool{"warning": true, "cutter": true, "stop": true}
+	for _, r := range cfg.Protection.Rules {
+		check(ruleTypes[r.Type], "protection rule "+r.Name+" type must be undervoltage, overcurrent or spike")
+		check(knownMonitor(r.Monitor), "protection rule "+r.Name+" monitor "+r.Monitor+" is not a power monitor")
+		check(r.Hysteresis >= 0, "protection rule "+r.Name+" hysteresis must not be negative")
+		for _, l := range r.Levels {
+			check(levels[l.Level], "protection rule "+r.Name+" level must be warning, cutter or stop")
+			check(l.Duration >= 0, "protection rule "+r.Name+" duration must not be negative")
+		}
+	}
+
+	check(cfg.Events.MaxFileSize >= 0 && cfg.Events.MaxFiles >= 0, "events.maxFileSize and maxFiles must not be negative")
+
+	check(cfg.Recorder.MaxSessions >= 0, "recorder.maxSessions must not be negative")
+
+	err = logger.Check(logger.SettingsStruct{Level: cfg.Logging.Level, Format: cfg.Logging.Format, Subsystems: cfg.Logging.Subsystems})
+	check(err == nil, fmt.Sprintf("logging: %v", err))
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Apply validates cfg and makes it the running config, it returns the keys that changed and which of those only take effect after a restart
+func Apply(cfg *ConfigStruct) (changed []string, restart []string, err error) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	if err := Validate(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	return apply(cfg)
+}
+
+// Update validates cfg and saves it to ConfigFile, then applies it with the environment and overrides on top just as a reload of the file would
+func Update(cfg *ConfigStruct) (changed []string, restart []string, err error) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	if err := Validate(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	values, err := toMap(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	running, err := withOverrides(values, ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := Save(cfg, ConfigFile); err != nil {
+		return nil, nil, err
+	}
+
+	return apply(running)
+}
+
+func apply(cfg *ConfigStruct) (changed []string, restart []string, err error) {
+	old := Current()
+
+	changed, err = changedKeys(old, cfg)
+	if err != nil || len(changed) == 0 {
+		return nil, nil, err
+	}
+
+	for _, key := range changed {
+		if needsRestart(key) {
+			restart = append(restart, key)
+		}
+	}
+
+	current.Store(cfg)
+
+	for _, fn := range changeHandlers {
+		fn(old, cfg)
+	}
+
+	return changed, restart, nil
+}
+
+// Save writes cfg over the config file in its own format, the previous file is kept alongside it as a .bak and a crash part way never leaves a truncated config
+func Save(cfg *ConfigStruct, file string) error {
+	data, err := encode(cfg, file)
+	if err != nil {
+		return err
+	}
+
+	if previous, err := ioutil.ReadFile(file); err == nil {
+		if err := ioutil.WriteFile(file+".bak", previous, 0644); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func needsRestart(key string) bool {
+	for _, prefix := range restartKeys {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changedKeys lists the dotted keys whose values differ or that are only in one of the two, lists are compared whole
+func changedKeys(old *ConfigStruct, new *ConfigStruct) ([]string, error) {
+	oldMap, err := toMap(old)
+	if err != nil {
+		return nil, err
+	}
+	newMap, err := toMap(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	var compare func(prefix string, a map[string]interface{}, b map[string]interface{})
+	compare = func(prefix string, a map[string]interface{}, b map[string]interface{}) {
+		for key, value := range b {
+			aMap, aIsMap := a[key].(map[string]interface{})
+			bMap, bIsMap := value.(map[string]interface{})
+			if aIsMap && bIsMap {
+				compare(prefix+key+".", aMap, bMap)
+			} else if !reflect.DeepEqual(a[key], value) {
+				keys = append(keys, prefix+key)
+			}
+		}
+
+		// removed keys, such as a logging subsystem or a power monitor that is gone from a map
+		for key := range a {
+			if _, ok := b[key]; !ok {
+				keys = append(keys, prefix+key)
+			}
+		}
+	}
+	compare("", oldMap, newMap)
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// mergePatch follows RFC 7386, objects are merged key by key, null removes a key and anything else replaces it
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+
+		patchMap, patchIsMap := value.(map[string]interface{})
+		targetMap, targetIsMap := target[key].(map[string]interface{})
+		if patchIsMap && targetIsMap {
+			target[key] = mergePatch(targetMap, patchMap)
+		} else {
+			target[key] = value
+		}
+	}
+
+	return target
+}
+
+func toMap(cfg *ConfigStruct) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &m)
+
+	return m, err
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dchote/robot-mower/src/logger"
+)
+
+func TestPatchRemovesMapEntry(t *testing.T) {
+	// the subsystems are registered by the packages that log through them, which this test does not import
+	logger.New("drivers")
+	logger.New("api")
+
+	dir, err := ioutil.TempDir("", "mower-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	data := `{"logging": {"subsystems": {"drivers": "debug", "api": "warn"}}}`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(file, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Patch([]byte(`{"logging": {"subsystems": {"drivers": null}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, _, err := Update(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"logging.subsystems.drivers"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed %v, want %v", changed, want)
+	}
+	if want := map[string]string{"api": "warn"}; !reflect.DeepEqual(Current().Logging.Subsystems, want) {
+		t.Errorf("running subsystems %v, want %v", Current().Logging.Subsystems, want)
+	}
+
+	saved, err := ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"api": "warn"}; !reflect.DeepEqual(saved.Logging.Subsystems, want) {
+		t.Errorf("saved subsystems %v, want %v", saved.Logging.Subsystems, want)
+	}
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/logger"
+)
+
+const (
+	watchInterval = 2 * time.Second
+)
+
+var (
+	log = logger.New("config")
+)
+
+// WatchConfig reloads ConfigFile whenever it changes on disk, it never returns
+func WatchConfig() {
+	last := fileVersion(ConfigFile)
+	pending := last
+
+	ticker := time.NewTicker(watchInterval)
+	for range ticker.C {
+		version := fileVersion(ConfigFile)
+
+		// an editor may be part way through writing, or have moved the file aside to replace it, wait until it settles
+		if version != pending || version == "" {
+			pending = version
+			continue
+		}
+		if version == last {
+			continue
+		}
+
+		last = version
+		ReloadConfig("file change")
+	}
+}
+
+// ReloadConfig re-reads ConfigFile and applies it, an invalid file is logged and the running config is left alone
+func ReloadConfig(reason string) {
+	changed, restart, err := reload()
+	if err != nil {
+		log.Errorf("not reloaded after %v, keeping the running config: %v", reason, err)
+		return
+	}
+
+	if len(changed) == 0 {
+		log.Infof("reloaded after %v, nothing changed", reason)
+		return
+	}
+
+	log.Infof("reloaded after %v, changed %v", reason, strings.Join(changed, ", "))
+	if len(restart) > 0 {
+		log.Warnf("restart to apply %v", strings.Join(restart, ", "))
+	}
+}
+
+func reload() (changed []string, restart []string, err error) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	cfg, err := ReadConfig(ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return apply(cfg)
+}
+
+func fileVersion(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%v %v", info.ModTime().UnixNano(), info.Size())
+}
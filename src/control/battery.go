@@ -0,0 +1,266 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/control/drivers"
+
+	"gobot.io/x/gobot/drivers/i2c"
+)
+
+const (
+	defaultVoltageNominal = 24.0
+	defaultVoltageWarn    = 22.0 // TODO figure out the exact value this needs to be
+
+	defaultBatteryHistoryWindow = 300 * time.Second
+	defaultBatteryReserve       = 5 * time.Minute
+
+	// the thermistor's nominal resistance is given at 25C
+	nominalThermistorKelvin = 298.15
+
+	// need at least this many discharging samples before trusting the voltage trend
+	minBatteryTrendSamples = 30
+
+	DockReasonManual     = "manual"
+	DockReasonLowBattery = "low_battery"
+)
+
+type batterySample struct {
+	time    time.Time
+	voltage float64
+	current float64
+}
+
+// UpdateBattery is called after each INA219 read, it predicts the remaining runtime and sends the mower home when it runs low
+func UpdateBattery() {
+	now := time.Now()
+
+	model := MowerController.batteryModel
+	model.Update(MowerState.Battery.Voltage, MowerState.Battery.Current, now)
+	MowerState.Battery.Status = model.Status()
+	MowerState.Battery.StateOfCharge = math.Round(model.StateOfCharge()*1000) / 10
+	MowerState.Battery.RemainingCapacity = math.Round(model.RemainingCapacity()*100) / 100
+
+	MowerController.batteryHealth.Record(now, MowerState.Battery.Voltage, MowerState.Battery.Current, MowerState.Battery.Temperature, model.Status(), MowerState.Battery.StateOfCharge, model.Capacity)
+
+	MowerController.batteryHistory = append(MowerController.batteryHistory, batterySample{
+		time:    now,
+		voltage: MowerState.Battery.Voltage,
+		current: MowerState.Battery.Current,
+	})
+
+	// drop samples that have aged out of the window
+	window := batteryHistoryWindow()
+	history := MowerController.batteryHistory
+	for len(history) > 0 && now.Sub(history[0].time) > window {
+		history = history[1:]
+	}
+	MowerController.batteryHistory = history
+
+	runtime, ok := PredictRuntime()
+	if ok {
+		MowerState.Battery.RemainingRuntime = math.Round(runtime.Seconds())
+	} else {
+		MowerState.Battery.RemainingRuntime = -1
+	}
+
+	checkLowBattery(runtime, ok)
+	checkLowBatteryResume()
+}
+
+// NewBatteryThermistor builds the ADC driver for the pack thermistor, nil when battery.temperature is not enabled
+func NewBatteryThermistor(c i2c.Connector) *drivers.ADS1115Driver {
+	t := config.Current().Battery.Temperature
+	if !t.Enabled {
+		return nil
+	}
+
+	return drivers.NewADS1115Driver(c, i2c.WithBus(t.Bus), i2c.WithAddress(t.Address))
+}
+
+// ReadBatteryTemperature converts the thermistor divider voltage to C with the beta equation, it runs on the robot loop so it only touches the ADC
+func ReadBatteryTemperature(adc *drivers.ADS1115Driver) (float64, error) {
+	t := config.Current().Battery.Temperature
+
+	volts, err := adc.ReadVoltage(t.Channel)
+	if err != nil {
+		return 0, err
+	}
+	if volts <= 0 || volts >= t.SupplyVoltage {
+		return 0, fmt.Errorf("thermistor reads %.3fV, it is shorted or disconnected", volts)
+	}
+
+	resistance := t.SeriesResistance * volts / (t.SupplyVoltage - volts)
+	kelvin := 1 / (1/nominalThermistorKelvin + math.Log(resistance/t.NominalResistance)/t.Beta)
+
+	return kelvin - 273.15, nil
+}
+
+// SetBatteryTemperature publishes a pack thermistor reading, the battery history picks it up with the next power reading
+func SetBatteryTemperature(celsius float64) {
+	record(RecordTemperature, celsius)
+
+	// a new value each time, copies of the state share the old one
+	temperature := math.Round(celsius*10) / 10
+	MowerState.Battery.Temperature = &temperature
+}
+
+// BatteryHistory returns a copy of the recorded charge/discharge cycles and pack health estimates, it must be called from the controller loop
+func BatteryHistory() *BatteryHistoryStruct {
+	return MowerController.batteryHealth.Snapshot()
+}
+
+// PredictRuntime extrapolates the discharge voltage trend down to VoltageWarn, ok is false while there is no usable trend
+func PredictRuntime() (runtime time.Duration, ok bool) {
+	var samples []batterySample
+	for _, s := range MowerController.batteryHistory {
+		if s.current > 0 {
+			samples = append(samples, s)
+		}
+	}
+	if len(samples) < minBatteryTrendSamples {
+		return 0, false
+	}
+
+	// least squares fit of voltage against seconds since the first sample
+	var sumT, sumV, sumTT, sumTV float64
+	for _, s := range samples {
+		t := s.time.Sub(samples[0].time).Seconds()
+		sumT += t
+		sumV += s.voltage
+		sumTT += t * t
+		sumTV += t * s.voltage
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumTT - sumT*sumT
+	if denominator == 0 {
+		return 0, false
+	}
+
+	slope := (n*sumTV - sumT*sumV) / denominator
+	if slope >= 0 {
+		return 0, false
+	}
+
+	headroom := MowerState.Battery.Voltage - MowerState.Battery.VoltageWarn
+	if headroom <= 0 {
+		return 0, true
+	}
+
+	return time.Duration(headroom / -slope * float64(time.Second)), true
+}
+
+// ReturnHomeTime estimates how long it takes to drive from the current pose back onto the dock
+func ReturnHomeTime() time.Duration {
+	cfg := config.Current()
+
+	approach := DockApproachPose()
+	travel := distance(MowerState.Pose.X, MowerState.Pose.Y, approach.X, approach.Y)
+
+	velocity := defaultMaxLinearVelocity
+	if cfg.Navigation.MaxLinearVelocity > 0 {
+		velocity = cfg.Navigation.MaxLinearVelocity
+	}
+
+	seconds := travel/velocity + (dockApproachDistance()+dockOvershoot)/dockCreepVelocity()
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// checkLowBattery pauses the running job and heads home once the predicted runtime no longer covers the trip plus the reserve
+func checkLowBattery(runtime time.Duration, ok bool) {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning {
+		return
+	}
+
+	low := MowerState.Battery.Voltage <= MowerState.Battery.VoltageWarn
+	if ok && runtime <= ReturnHomeTime()+batteryReserve() {
+		low = true
+	}
+	if !low {
+		return
+	}
+
+	log.Warnf("battery: low, %vV with %v runtime remaining, returning home", MowerState.Battery.Voltage, runtime)
+	RecordEvent(EventSeverityWarning, EventTypeBattery,
+		fmt.Sprintf("battery low at %vV, returning home", MowerState.Battery.Voltage), MowerState.Battery)
+
+	MowerController.lowBatteryJobID = job.ID
+	if err := ReturnHome(); err != nil {
+		log.Errorf("battery: unable to return home: %v", err)
+		return
+	}
+	MowerState.Dock.Reason = DockReasonLowBattery
+}
+
+// checkLowBatteryResume resumes the job that was interrupted for charging once the battery is back above the resume threshold
+func checkLowBatteryResume() {
+	cfg := config.Current()
+
+	if MowerController.lowBatteryJobID == "" {
+		return
+	}
+
+	job := MowerController.job
+	if job == nil || job.ID != MowerController.lowBatteryJobID || job.Status != JobStatusPaused {
+		// the job was aborted or resumed by hand while we were away
+		MowerController.lowBatteryJobID = ""
+		return
+	}
+
+	if MowerState.Dock.Status != DockStatusDocked || !MowerState.Dock.Charging {
+		return
+	}
+
+	if cfg.Battery.ResumeStateOfCharge > 0 {
+		if MowerState.Battery.StateOfCharge < cfg.Battery.ResumeStateOfCharge {
+			return
+		}
+	} else if MowerState.Battery.Voltage < batteryResumeVoltage() {
+		return
+	}
+
+	log.Infof("battery: charged to %vV (%v%%), resuming job %v", MowerState.Battery.Voltage, MowerState.Battery.StateOfCharge, job.ID)
+
+	MowerController.lowBatteryJobID = ""
+	MowerState.Dock.Status = DockStatusIdle
+	MowerState.Dock.Reason = ""
+
+	// the pre-charge discharge curve says nothing about the freshly charged pack
+	MowerController.batteryHistory = nil
+
+	if err := ResumeJob(); err != nil {
+		log.Errorf("battery: unable to resume job: %v", err)
+	}
+}
+
+func batteryHistoryWindow() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Battery.HistoryWindow > 0 {
+		return time.Duration(cfg.Battery.HistoryWindow) * time.Second
+	}
+	return defaultBatteryHistoryWindow
+}
+
+func batteryReserve() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Battery.ReserveMinutes > 0 {
+		return time.Duration(cfg.Battery.ReserveMinutes * float64(time.Minute))
+	}
+	return defaultBatteryReserve
+}
+
+func batteryResumeVoltage() float64 {
+	cfg := config.Current()
+
+	if cfg.Battery.ResumeVoltage > 0 {
+		return cfg.Battery.ResumeVoltage
+	}
+	return MowerState.Battery.VoltageNominal
+}
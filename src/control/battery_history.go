@@ -0,0 +1,280 @@
+package control
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	CycleTypeCharge    = "charge"
+	CycleTypeDischarge = "discharge"
+
+	batteryHistoryFile         = "battery_history.json"
+	batteryHistorySaveInterval = 5 * time.Minute
+
+	// only keep this many cycles on disk, the totals still cover every cycle
+	maxBatteryCycles = 500
+
+	// a current change at least this large between two samples is treated as a load step for resistance estimates
+	resistanceCurrentStep = 0.5
+	// samples further apart than this are too slow to separate sag from state of charge drift
+	resistanceMaxSampleGap = 2 * time.Second
+	// weight given to each new resistance estimate in the running average
+	resistanceSmoothing = 0.1
+
+	// the pack has to stay charging or discharging this long before a new cycle starts, so current hovering around 0A does not split cycles
+	cycleSwitchDelay = 30 * time.Second
+	// a discharge only counts towards DischargeCycles once it has taken at least this many percent of charge
+	minDischargeCycleDepth = 5.0
+)
+
+// BatteryCycleStruct is one charge or discharge
+type BatteryCycleStruct struct {
+	Number    int       `json:"number"`
+	Type      string    `json:"type"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at,omitempty"`
+
+	StartStateOfCharge float64 `json:"start_state_of_charge"`
+	EndStateOfCharge   float64 `json:"end_state_of_charge"`
+
+	// charge and energy moved in the direction of the cycle
+	AmpHours  float64 `json:"amp_hours"`
+	WattHours float64 `json:"watt_hours"`
+
+	MinVoltage  float64 `json:"min_voltage"`
+	MaxVoltage  float64 `json:"max_voltage"`
+	PeakCurrent float64 `json:"peak_current"`
+	// C, only recorded with a pack thermistor
+	PeakTemperature *float64 `json:"peak_temperature,omitempty"`
+
+	// mean of the internal resistance estimates taken during the cycle, in ohms
+	InternalResistance float64 `json:"internal_resistance"`
+	resistanceSamples  int
+}
+
+type BatteryHistoryStruct struct {
+	Cycles []*BatteryCycleStruct `json:"cycles"`
+	Active *BatteryCycleStruct   `json:"active,omitempty"`
+
+	// finished discharges at least minDischargeCycleDepth deep
+	DischargeCycles      int     `json:"discharge_cycles"`
+	EquivalentFullCycles float64 `json:"equivalent_full_cycles"`
+	TotalDischargedAh    float64 `json:"total_discharged_ah"`
+	TotalDischargedWh    float64 `json:"total_discharged_wh"`
+
+	// smoothed internal resistance across all cycles, in ohms
+	InternalResistance float64 `json:"internal_resistance"`
+
+	lastSample batterySample
+	savedAt    time.Time
+
+	// the cycle type the pack has switched to and since when, until it has held for cycleSwitchDelay
+	pendingType  string
+	pendingSince time.Time
+}
+
+// LoadBatteryHistory reads the persisted battery history, starting a fresh one if there is none
+func LoadBatteryHistory() *BatteryHistoryStruct {
+	history := &BatteryHistoryStruct{}
+
+	data, err := ioutil.ReadFile(batteryHistoryPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read battery history: %v", err)
+		}
+		return history
+	}
+
+	err = json.Unmarshal(data, history)
+	if err != nil {
+		log.Errorf("unable to decode battery history: %v", err)
+		return &BatteryHistoryStruct{}
+	}
+
+	// a cycle that was in progress when we lost power is closed off at its last update
+	if history.Active != nil {
+		history.finishCycle(history.Active.EndedAt)
+	}
+
+	return history
+}
+
+// Snapshot returns a copy of the history that is safe to encode off the controller loop while sampling carries on
+func (h *BatteryHistoryStruct) Snapshot() *BatteryHistoryStruct {
+	snapshot := &BatteryHistoryStruct{
+		Cycles:               make([]*BatteryCycleStruct, 0, len(h.Cycles)),
+		DischargeCycles:      h.DischargeCycles,
+		EquivalentFullCycles: h.EquivalentFullCycles,
+		TotalDischargedAh:    h.TotalDischargedAh,
+		TotalDischargedWh:    h.TotalDischargedWh,
+		InternalResistance:   h.InternalResistance,
+	}
+	for _, cycle := range h.Cycles {
+		c := *cycle
+		snapshot.Cycles = append(snapshot.Cycles, &c)
+	}
+	if h.Active != nil {
+		active := *h.Active
+		snapshot.Active = &active
+	}
+
+	return snapshot
+}
+
+// Record folds the latest battery sample into the active cycle, starting a new cycle once the pack has switched between charging and discharging for cycleSwitchDelay, temperature is nil without a thermistor
+func (h *BatteryHistoryStruct) Record(now time.Time, voltage float64, current float64, temperature *float64, status string, stateOfCharge float64, capacity float64) {
+	cycleType := ""
+	if status == BatteryStatusDischarging {
+		cycleType = CycleTypeDischarge
+	} else if status == BatteryStatusCharging {
+		cycleType = CycleTypeCharge
+	}
+
+	if cycleType != "" && (h.Active == nil || h.Active.Type != cycleType) {
+		if h.pendingType != cycleType {
+			h.pendingType = cycleType
+			h.pendingSince = now
+		}
+
+		// the new cycle starts from when the switch was first seen
+		if h.Active == nil {
+			h.startCycle(now, cycleType, stateOfCharge, voltage)
+		} else if now.Sub(h.pendingSince) >= cycleSwitchDelay {
+			h.finishCycle(h.pendingSince)
+			h.startCycle(h.pendingSince, cycleType, stateOfCharge, voltage)
+		}
+	} else {
+		h.pendingType = ""
+	}
+
+	last := h.lastSample
+	h.lastSample = batterySample{time: now, voltage: voltage, current: current}
+
+	cycle := h.Active
+	if cycle == nil {
+		return
+	}
+
+	cycle.EndedAt = now
+	cycle.EndStateOfCharge = stateOfCharge
+	cycle.MinVoltage = math.Min(cycle.MinVoltage, voltage)
+	cycle.MaxVoltage = math.Max(cycle.MaxVoltage, voltage)
+	cycle.PeakCurrent = math.Max(cycle.PeakCurrent, math.Abs(current))
+	if temperature != nil && (cycle.PeakTemperature == nil || *temperature > *cycle.PeakTemperature) {
+		peak := *temperature
+		cycle.PeakTemperature = &peak
+	}
+
+	if last.time.IsZero() {
+		return
+	}
+	dt := now.Sub(last.time)
+
+	// only count charge moving in the direction of the cycle
+	ah := (last.current + current) / 2 * dt.Hours()
+	wh := (last.current*last.voltage + current*voltage) / 2 * dt.Hours()
+	if cycle.Type == CycleTypeCharge {
+		ah, wh = -ah, -wh
+	}
+	if ah > 0 {
+		cycle.AmpHours += ah
+		cycle.WattHours += wh
+
+		if cycle.Type == CycleTypeDischarge {
+			h.TotalDischargedAh += ah
+			h.TotalDischargedWh += wh
+			if capacity > 0 {
+				h.EquivalentFullCycles = h.TotalDischargedAh / capacity
+			}
+		}
+	}
+
+	// voltage sag across a sudden load step gives R = -dV/dI, charger transitions are not load steps
+	step := current - last.current
+	if last.current > 0 && current > 0 && dt <= resistanceMaxSampleGap && math.Abs(step) >= resistanceCurrentStep {
+		resistance := -(voltage - last.voltage) / step
+		if resistance > 0 {
+			cycle.InternalResistance = (cycle.InternalResistance*float64(cycle.resistanceSamples) + resistance) / float64(cycle.resistanceSamples+1)
+			cycle.resistanceSamples++
+
+			if h.InternalResistance == 0 {
+				h.InternalResistance = resistance
+			} else {
+				h.InternalResistance += (resistance - h.InternalResistance) * resistanceSmoothing
+			}
+		}
+	}
+
+	if now.Sub(h.savedAt) >= batteryHistorySaveInterval {
+		h.save()
+	}
+}
+
+func (h *BatteryHistoryStruct) startCycle(now time.Time, cycleType string, stateOfCharge float64, voltage float64) {
+	number := 1
+	if len(h.Cycles) > 0 {
+		number = h.Cycles[len(h.Cycles)-1].Number + 1
+	}
+
+	h.Active = &BatteryCycleStruct{
+		Number:             number,
+		Type:               cycleType,
+		StartedAt:          now,
+		EndedAt:            now,
+		StartStateOfCharge: stateOfCharge,
+		EndStateOfCharge:   stateOfCharge,
+		MinVoltage:         voltage,
+		MaxVoltage:         voltage,
+	}
+
+	log.Infof("battery: %v cycle %v started at %v%%", cycleType, number, stateOfCharge)
+}
+
+func (h *BatteryHistoryStruct) finishCycle(now time.Time) {
+	cycle := h.Active
+	cycle.EndedAt = now
+	cycle.AmpHours = math.Round(cycle.AmpHours*1000) / 1000
+	cycle.WattHours = math.Round(cycle.WattHours*100) / 100
+	cycle.InternalResistance = math.Round(cycle.InternalResistance*10000) / 10000
+
+	if cycle.Type == CycleTypeDischarge && cycle.StartStateOfCharge-cycle.EndStateOfCharge >= minDischargeCycleDepth {
+		h.DischargeCycles++
+	}
+
+	h.Cycles = append(h.Cycles, cycle)
+	if len(h.Cycles) > maxBatteryCycles {
+		h.Cycles = h.Cycles[len(h.Cycles)-maxBatteryCycles:]
+	}
+	h.Active = nil
+
+	log.Infof("battery: %v cycle %v finished, %vAh %vWh", cycle.Type, cycle.Number, cycle.AmpHours, cycle.WattHours)
+
+	h.save()
+}
+
+func (h *BatteryHistoryStruct) save() {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		log.Errorf("unable to encode battery history: %v", err)
+		return
+	}
+
+	err = writeFileAtomic(batteryHistoryPath(), data)
+	if err != nil {
+		log.Errorf("unable to write battery history: %v", err)
+		return
+	}
+
+	h.savedAt = time.Now()
+}
+
+func batteryHistoryPath() string {
+	return filepath.Join(config.Current().Mower.DataDirectory, batteryHistoryFile)
+}
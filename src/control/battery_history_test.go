@@ -0,0 +1,73 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatteryHistoryIgnoresCurrentNoise(t *testing.T) {
+	startTestController(t)
+
+	h := &BatteryHistoryStruct{}
+	now := time.Now()
+	warm, hot := 31.0, 38.5
+
+	// discharging from 100% with the current flicking to charging for a couple of seconds now and then
+	soc := 100.0
+	for i := 0; i < 600; i++ {
+		status, current := BatteryStatusDischarging, 1.5
+		if i%60 == 30 || i%60 == 31 {
+			status, current = BatteryStatusCharging, -0.1
+		}
+		temperature := &warm
+		if i == 300 {
+			temperature = &hot
+		}
+
+		h.Record(now.Add(time.Duration(i)*time.Second), 24, current, temperature, status, soc, 5)
+		soc -= 0.02
+	}
+
+	// then a real charge, long enough to start a new cycle
+	for i := 600; i < 700; i++ {
+		h.Record(now.Add(time.Duration(i)*time.Second), 25, -2, nil, BatteryStatusCharging, soc, 5)
+	}
+
+	if len(h.Cycles) != 1 || h.Cycles[0].Type != CycleTypeDischarge {
+		t.Fatalf("finished cycles %+v, want the one discharge", h.Cycles)
+	}
+	if h.Active == nil || h.Active.Type != CycleTypeCharge {
+		t.Fatalf("active cycle %+v, want a charge", h.Active)
+	}
+	if h.DischargeCycles != 1 {
+		t.Errorf("%v discharge cycles, want 1", h.DischargeCycles)
+	}
+	if peak := h.Cycles[0].PeakTemperature; peak == nil || *peak != hot {
+		t.Errorf("peak temperature %v, want %v", peak, hot)
+	}
+	if h.Active.PeakTemperature != nil {
+		t.Errorf("charge peak temperature %v without a thermistor reading, want none", *h.Active.PeakTemperature)
+	}
+}
+
+func TestBatteryHistoryShallowDischarge(t *testing.T) {
+	startTestController(t)
+
+	h := &BatteryHistoryStruct{}
+	now := time.Now()
+
+	// a couple of percent used on the dock is a cycle in the history but not a discharge cycle of the pack
+	for i := 0; i < 100; i++ {
+		h.Record(now.Add(time.Duration(i)*time.Second), 24, 0.5, nil, BatteryStatusDischarging, 90-float64(i)*0.02, 5)
+	}
+	for i := 100; i < 200; i++ {
+		h.Record(now.Add(time.Duration(i)*time.Second), 25, -2, nil, BatteryStatusCharging, 88, 5)
+	}
+
+	if len(h.Cycles) != 1 {
+		t.Fatalf("%v finished cycles, want 1", len(h.Cycles))
+	}
+	if h.DischargeCycles != 0 {
+		t.Errorf("%v discharge cycles, want 0", h.DischargeCycles)
+	}
+}
@@ -0,0 +1,183 @@
+package control
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	BatteryStatusCharging    = "Charging"
+	BatteryStatusDischarging = "Discharging"
+	BatteryStatusFull        = "Full"
+	BatteryStatusIdle        = "Idle"
+
+	defaultBatteryCapacity  = 5.0 // Ah
+	defaultBatteryCells     = 6
+	defaultBatteryChemistry = "lipo"
+
+	// below this many amps either way the pack is considered at rest
+	defaultRestCurrent = 0.05
+	// how long the pack has to be at rest before its terminal voltage is trusted as open circuit voltage
+	defaultRestTime = 60 * time.Second
+	// share of the gap to the open circuit estimate closed on each rested update
+	restCorrectionGain = 0.05
+
+	fullStateOfCharge = 0.99
+)
+
+// OCVPoint maps a per cell open circuit voltage to a state of charge between 0 and 1
+type OCVPoint struct {
+	Voltage       float64
+	StateOfCharge float64
+}
+
+var (
+	lipoCurve = []OCVPoint{
+		{3.27, 0.00}, {3.61, 0.05}, {3.69, 0.10}, {3.71, 0.15}, {3.73, 0.20}, {3.75, 0.25}, {3.77, 0.30},
+		{3.79, 0.35}, {3.80, 0.40}, {3.82, 0.45}, {3.84, 0.50}, {3.85, 0.55}, {3.87, 0.60}, {3.91, 0.65},
+		{3.95, 0.70}, {3.98, 0.75}, {4.02, 0.80}, {4.08, 0.85}, {4.11, 0.90}, {4.15, 0.95}, {4.20, 1.00},
+	}
+
+	liionCurve = []OCVPoint{
+		{3.00, 0.00}, {3.40, 0.05}, {3.55, 0.10}, {3.64, 0.20}, {3.70, 0.30}, {3.74, 0.40},
+		{3.79, 0.50}, {3.85, 0.60}, {3.92, 0.70}, {4.00, 0.80}, {4.10, 0.90}, {4.20, 1.00},
+	}
+)
+
+// BatteryModelStruct estimates state of charge by coulomb counting, corrected against the open circuit voltage curve whenever the pack rests
+type BatteryModelStruct struct {
+	Capacity    float64
+	Cells       int
+	Curve       []OCVPoint
+	RestCurrent float64
+	RestTime    time.Duration
+
+	stateOfCharge float64
+	status        string
+	lastUpdate    time.Time
+	restSince     time.Time
+	initialized   bool
+}
+
+// NewBatteryModel builds a model from the battery section of config.json
+func NewBatteryModel() *BatteryModelStruct {
+	cfg := config.Current().Battery
+
+	b := &BatteryModelStruct{
+		Capacity:    defaultBatteryCapacity,
+		Cells:       defaultBatteryCells,
+		Curve:       lipoCurve,
+		RestCurrent: defaultRestCurrent,
+		RestTime:    defaultRestTime,
+		status:      "Unknown",
+	}
+
+	if cfg.Capacity > 0 {
+		b.Capacity = cfg.Capacity
+	}
+	if cfg.Cells > 0 {
+		b.Cells = cfg.Cells
+	}
+	if cfg.RestCurrent > 0 {
+		b.RestCurrent = cfg.RestCurrent
+	}
+	if cfg.RestTime > 0 {
+		b.RestTime = time.Duration(cfg.RestTime) * time.Second
+	}
+
+	chemistry := strings.ToLower(cfg.Chemistry)
+	if chemistry == "" {
+		chemistry = defaultBatteryChemistry
+	}
+	if chemistry == "liion" || chemistry == "li-ion" {
+		b.Curve = liionCurve
+	}
+
+	// a curve in config.json overrides the built in chemistry curves
+	if len(cfg.OCVCurve) >= 2 {
+		b.Curve = make([]OCVPoint, 0, len(cfg.OCVCurve))
+		for _, p := range cfg.OCVCurve {
+			b.Curve = append(b.Curve, OCVPoint{Voltage: p[0], StateOfCharge: p[1] / 100})
+		}
+		sort.Slice(b.Curve, func(i, j int) bool { return b.Curve[i].Voltage < b.Curve[j].Voltage })
+	}
+
+	return b
+}
+
+// Update integrates the measured current since the last call, current is positive while discharging
+func (b *BatteryModelStruct) Update(voltage float64, current float64, now time.Time) {
+	if !b.initialized {
+		// first reading, the best we can do is assume the pack has been sitting at rest
+		b.stateOfCharge = b.StateOfChargeFromVoltage(voltage)
+		b.lastUpdate = now
+		b.restSince = now
+		b.initialized = true
+		b.updateStatus(current)
+		return
+	}
+
+	dt := now.Sub(b.lastUpdate).Hours()
+	b.lastUpdate = now
+
+	b.stateOfCharge -= current * dt / b.Capacity
+
+	if math.Abs(current) > b.RestCurrent {
+		b.restSince = now
+	} else if now.Sub(b.restSince) >= b.RestTime {
+		b.stateOfCharge += (b.StateOfChargeFromVoltage(voltage) - b.stateOfCharge) * restCorrectionGain
+	}
+
+	b.stateOfCharge = math.Max(0, math.Min(b.stateOfCharge, 1))
+	b.updateStatus(current)
+}
+
+// StateOfChargeFromVoltage looks up the pack voltage on the open circuit voltage curve, interpolating between points
+func (b *BatteryModelStruct) StateOfChargeFromVoltage(voltage float64) float64 {
+	cell := voltage / float64(b.Cells)
+
+	if cell <= b.Curve[0].Voltage {
+		return b.Curve[0].StateOfCharge
+	}
+	for i := 1; i < len(b.Curve); i++ {
+		if cell <= b.Curve[i].Voltage {
+			lower, upper := b.Curve[i-1], b.Curve[i]
+			ratio := (cell - lower.Voltage) / (upper.Voltage - lower.Voltage)
+			return lower.StateOfCharge + ratio*(upper.StateOfCharge-lower.StateOfCharge)
+		}
+	}
+
+	return b.Curve[len(b.Curve)-1].StateOfCharge
+}
+
+// StateOfCharge returns the estimated state of charge between 0 and 1
+func (b *BatteryModelStruct) StateOfCharge() float64 {
+	return b.stateOfCharge
+}
+
+// RemainingCapacity returns the estimated charge left in the pack in Ah
+func (b *BatteryModelStruct) RemainingCapacity() float64 {
+	return b.stateOfCharge * b.Capacity
+}
+
+// Status returns one of the BatteryStatus values
+func (b *BatteryModelStruct) Status() string {
+	return b.status
+}
+
+func (b *BatteryModelStruct) updateStatus(current float64) {
+	switch {
+	case current > b.RestCurrent:
+		b.status = BatteryStatusDischarging
+	case b.stateOfCharge >= fullStateOfCharge:
+		b.status = BatteryStatusFull
+	case current < -b.RestCurrent:
+		b.status = BatteryStatusCharging
+	default:
+		b.status = BatteryStatusIdle
+	}
+}
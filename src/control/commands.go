@@ -0,0 +1,407 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/dchote/robot-mower/src/auth"
+)
+
+type SpeedPayload struct {
+	Speed int `json:"speed"`
+}
+
+type DirectionPayload struct {
+	Direction string `json:"direction"`
+}
+
+// VelocityPayload is a normalized joystick velocity, both components are -1..1 and positive angular turns left
+type VelocityPayload struct {
+	Linear  float64 `json:"linear"`
+	Angular float64 `json:"angular"`
+}
+
+type FollowPathPayload struct {
+	Waypoints []Waypoint `json:"waypoints"`
+}
+
+type CoveragePayload struct {
+	Zone string `json:"zone"`
+}
+
+// commandStruct describes one command method, the same definition serves every protocol version
+type commandStruct struct {
+	// newPayload returns a pointer to decode the payload into, nil when the command takes none
+	newPayload func() interface{}
+	// legacyPayload converts the string value of a version 0 command into the typed payload
+	legacyPayload func(value string) (interface{}, error)
+	run           func(caller ControllerIdentity, payload interface{}) (interface{}, error)
+	// observers may call this without holding the control lease
+	observer bool
+	// the least role allowed to call this, operator when empty
+	role string
+}
+
+type validator interface {
+	Validate() error
+}
+
+var (
+	directions = map[string]bool{"forward": true, "backward": true, "left": true, "right": true}
+
+	commands = map[string]commandStruct{
+		"setMowerDriveSpeed": {
+			newPayload:    func() interface{} { return &SpeedPayload{} },
+			legacyPayload: legacySpeed,
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				MowerState.Drive.Speed = payload.(*SpeedPayload).Speed
+				return nil, nil
+			},
+		},
+		"setMowerCutterSpeed": {
+			newPayload:    func() interface{} { return &SpeedPayload{} },
+			legacyPayload: legacySpeed,
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				speed := payload.(*SpeedPayload).Speed
+
+				// stopping the cutter is always allowed
+				if speed > 0 && !ProtectionAllowsCutter() {
+					return nil, errors.New("cutter is held off by protection level " + MowerState.Protection.Level)
+				}
+
+				MowerState.Cutter.Speed = speed
+				return nil, nil
+			},
+		},
+		"requestDirectionStart": {
+			newPayload: func() interface{} { return &DirectionPayload{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				return &DirectionPayload{Direction: value}, nil
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				if !ProtectionAllowsDrive() {
+					return nil, errors.New("drive is held off by protection level " + MowerState.Protection.Level)
+				}
+
+				// manual driving always takes over from a running job or docking
+				if MowerState.Mode == ModeAutonomous {
+					CancelReturnHome()
+					PauseJob()
+				}
+
+				// a held direction button replaces any joystick velocity
+				StopDrive()
+
+				// TODO actual callout logic, right now we'll just update state
+				MowerState.Drive.Direction = payload.(*DirectionPayload).Direction
+				return nil, nil
+			},
+		},
+		"setVelocity": {
+			newPayload: func() interface{} { return &VelocityPayload{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				// the version 0 value is a JSON encoded VelocityPayload
+				payload := &VelocityPayload{}
+				err := json.Unmarshal([]byte(value), payload)
+				return payload, err
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				velocity := payload.(*VelocityPayload)
+				return nil, SetVelocity(velocity.Linear, velocity.Angular)
+			},
+		},
+		"requestDirectionStop": {
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				StopDrive()
+				return nil, nil
+			},
+		},
+		"followPath": {
+			newPayload: func() interface{} { return &FollowPathPayload{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				// the version 0 value is a JSON encoded list of waypoints
+				payload := &FollowPathPayload{}
+				err := json.Unmarshal([]byte(value), &payload.Waypoints)
+				return payload, err
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				if !ProtectionAllowsDrive() {
+					return nil, errors.New("drive is held off by protection level " + MowerState.Protection.Level)
+				}
+
+				FollowPath(payload.(*FollowPathPayload).Waypoints)
+				return nil, nil
+			},
+		},
+		"stopPath": {
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				StopPath()
+				return nil, nil
+			},
+		},
+		"startJob": {
+			newPayload: func() interface{} { return &JobRequest{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				// the version 0 value is a JSON encoded JobRequest
+				request := &JobRequest{}
+				err := json.Unmarshal([]byte(value), request)
+				return request, err
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				if err := StartJob(*payload.(*JobRequest)); err != nil {
+					return nil, err
+				}
+				return CurrentJob(), nil
+			},
+		},
+		"acquireControl": {
+			newPayload: func() interface{} { return &ControlPayload{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				return &ControlPayload{Takeover: value == "takeover"}, nil
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				if err := AcquireControl(caller, payload.(*ControlPayload).Takeover); err != nil {
+					return nil, err
+				}
+				return MowerState.Control, nil
+			},
+			observer: true,
+		},
+		"releaseControl": {
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				if err := ReleaseControl(caller); err != nil {
+					return nil, err
+				}
+				return MowerState.Control, nil
+			},
+			observer: true,
+		},
+		"emergencyStop": {
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				EmergencyStop(caller)
+				return nil, nil
+			},
+			// anyone watching may stop the mower, whoever holds control
+			observer: true,
+			role:     auth.RoleViewer,
+		},
+		"resetCoverage": {
+			newPayload: func() interface{} { return &CoveragePayload{} },
+			legacyPayload: func(value string) (interface{}, error) {
+				return &CoveragePayload{Zone: value}, nil
+			},
+			run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+				m, err := CoverageMap(payload.(*CoveragePayload).Zone)
+				if err != nil {
+					return nil, err
+				}
+
+				m.Reset()
+				return nil, m.Save()
+			},
+		},
+		"pauseJob":         jobCommand(PauseJob),
+		"resumeJob":        jobCommand(ResumeJob),
+		"abortJob":         jobCommand(AbortJob),
+		"returnHome":       dockCommand(ReturnHome),
+		"cancelReturnHome": dockCommand(func() error { CancelReturnHome(); return nil }),
+	}
+)
+
+func (p *SpeedPayload) Validate() error {
+	if p.Speed < 0 || p.Speed > 100 {
+		return errors.New("speed must be between 0 and 100")
+	}
+
+	return nil
+}
+
+func (p *DirectionPayload) Validate() error {
+	if !directions[p.Direction] {
+		return errors.New("direction must be one of forward, backward, left or right")
+	}
+
+	return nil
+}
+
+func (p *VelocityPayload) Validate() error {
+	if p.Linear < -1 || p.Linear > 1 || p.Angular < -1 || p.Angular > 1 {
+		return errors.New("linear and angular must be between -1 and 1")
+	}
+
+	return nil
+}
+
+func (p *FollowPathPayload) Validate() error {
+	if len(p.Waypoints) == 0 {
+		return errors.New("waypoints must contain at least one waypoint")
+	}
+
+	return nil
+}
+
+func (p *CoveragePayload) Validate() error {
+	if p.Zone == "" {
+		return errors.New("zone must be set")
+	}
+
+	return nil
+}
+
+func (r *JobRequest) Validate() error {
+	if len(r.Plan) == 0 {
+		return errors.New("plan must contain at least one waypoint")
+	}
+
+	return nil
+}
+
+// CommandMethods lists every command method clients may call
+func CommandMethods() []string {
+	methods := make([]string, 0, len(commands))
+	for method := range commands {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return methods
+}
+
+// CommandDescription describes a command method for API documentation
+type CommandDescription struct {
+	Method string
+	// a zero value of the payload type, nil when the command takes none
+	Payload interface{}
+	Role    string
+	// whether the caller has to hold the control lease
+	NeedsControl bool
+}
+
+// DescribeCommands describes every command method in the same order as CommandMethods
+func DescribeCommands() []CommandDescription {
+	descriptions := []CommandDescription{}
+	for _, method := range CommandMethods() {
+		command := commands[method]
+
+		description := CommandDescription{Method: method, Role: command.role, NeedsControl: !command.observer}
+		if description.Role == "" {
+			description.Role = auth.RoleOperator
+		}
+		if command.newPayload != nil {
+			description.Payload = command.newPayload()
+		}
+
+		descriptions = append(descriptions, description)
+	}
+
+	return descriptions
+}
+
+// ExecuteCommand decodes, validates and runs a command on behalf of caller, it must only be called from the controller loop
+func ExecuteCommand(caller ControllerIdentity, method string, data json.RawMessage) (interface{}, *ProtocolError) {
+	command, ok := commands[method]
+	if !ok {
+		return nil, &ProtocolError{Code: ErrorCodeUnknownMethod, Message: "unknown method " + method}
+	}
+
+	var payload interface{}
+	if command.newPayload != nil {
+		payload = command.newPayload()
+		if len(data) == 0 {
+			return nil, &ProtocolError{Code: ErrorCodeInvalidPayload, Message: method + " requires a payload"}
+		}
+		if err := json.Unmarshal(data, payload); err != nil {
+			return nil, &ProtocolError{Code: ErrorCodeInvalidPayload, Message: err.Error()}
+		}
+	}
+
+	return runCommand(caller, method, command, payload)
+}
+
+// executeLegacyCommand runs a version 0 {method, value} command through the same validation as the current protocol
+func executeLegacyCommand(caller ControllerIdentity, message CommandMessage) *ProtocolError {
+	command, ok := commands[message.Method]
+	if !ok {
+		return &ProtocolError{Code: ErrorCodeUnknownMethod, Message: "unknown method " + message.Method}
+	}
+
+	var payload interface{}
+	if command.legacyPayload != nil {
+		var err error
+		payload, err = command.legacyPayload(message.Value)
+		if err != nil {
+			return &ProtocolError{Code: ErrorCodeInvalidPayload, Message: err.Error()}
+		}
+	}
+
+	_, err := runCommand(caller, message.Method, command, payload)
+	return err
+}
+
+// runCommand checks and runs a decoded command, every command is recorded here with its outcome so a replay can tell if it went differently
+func runCommand(caller ControllerIdentity, method string, command commandStruct, payload interface{}) (result interface{}, err *ProtocolError) {
+	defer func() {
+		recordCommand(caller, method, payload, err)
+	}()
+
+	// viewers may watch and subscribe but nearly every command needs an operator
+	role := command.role
+	if role == "" {
+		role = auth.RoleOperator
+	}
+	if !auth.RoleAllows(caller.Role, role) {
+		return nil, &ProtocolError{Code: ErrorCodeForbidden, Message: role + " role required"}
+	}
+
+	if v, ok := payload.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, &ProtocolError{Code: ErrorCodeInvalidPayload, Message: err.Error()}
+		}
+	}
+
+	if !command.observer {
+		if err := checkControl(caller); err != nil {
+			return nil, &ProtocolError{Code: ErrorCodeNotInControl, Message: err.Error()}
+		}
+	}
+
+	result, runErr := command.run(caller, payload)
+	if runErr != nil {
+		return nil, &ProtocolError{Code: ErrorCodeRejected, Message: runErr.Error()}
+	}
+
+	return result, nil
+}
+
+func legacySpeed(value string) (interface{}, error) {
+	speed, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errors.New("speed must be an integer")
+	}
+
+	return &SpeedPayload{Speed: speed}, nil
+}
+
+func jobCommand(action func() error) commandStruct {
+	return commandStruct{
+		run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+			if err := action(); err != nil {
+				return nil, err
+			}
+			return CurrentJob(), nil
+		},
+	}
+}
+
+func dockCommand(action func() error) commandStruct {
+	return commandStruct{
+		run: func(caller ControllerIdentity, payload interface{}) (interface{}, error) {
+			if err := action(); err != nil {
+				return nil, err
+			}
+			return MowerState.Dock, nil
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package control
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dchote/robot-mower/src/auth"
+)
+
+func TestCutterStopsUnderProtection(t *testing.T) {
+	startTestController(t)
+
+	var startErr, stopErr error
+	var speed int
+	Do(func() {
+		MowerState.Protection.Level = ProtectionLevelCutter
+		MowerState.Cutter.Speed = 40
+
+		run := commands["setMowerCutterSpeed"].run
+		_, startErr = run(ControllerIdentity{}, &SpeedPayload{Speed: 60})
+		_, stopErr = run(ControllerIdentity{}, &SpeedPayload{Speed: 0})
+		speed = MowerState.Cutter.Speed
+
+		MowerState.Protection.Level = ProtectionLevelNone
+	})
+
+	if startErr == nil {
+		t.Error("cutter started while protection holds it off")
+	}
+	if stopErr != nil {
+		t.Errorf("stopping the cutter was refused: %v", stopErr)
+	}
+	if speed != 0 {
+		t.Errorf("cutter speed %v, want 0", speed)
+	}
+}
+
+func TestResetCoverageCommand(t *testing.T) {
+	startTestController(t)
+
+	caller := ControllerIdentity{ID: "test", Role: auth.RoleOperator}
+
+	var missing, empty, resetErr *ProtocolError
+	var before, covered float64
+	Do(func() {
+		zone := Zone{Name: "reset", Boundary: []Waypoint{{X: 0, Y: 0}, {X: 4, Y: 0}, {X: 4, Y: 4}, {X: 0, Y: 4}}}
+		m, err := NewCoverageMap(zone, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		m.Sweep(Pose{X: 1, Y: 1})
+		m.Sweep(Pose{X: 3, Y: 1})
+		MowerController.coverage[zone.Name] = m
+		before = m.PercentCovered()
+
+		_, missing = ExecuteCommand(caller, "resetCoverage", json.RawMessage(`{"zone":"nowhere"}`))
+		_, empty = ExecuteCommand(caller, "resetCoverage", json.RawMessage(`{}`))
+		_, resetErr = ExecuteCommand(caller, "resetCoverage", json.RawMessage(`{"zone":"reset"}`))
+		covered = m.PercentCovered()
+
+		ReleaseControl(caller)
+	})
+
+	if missing == nil || missing.Code != ErrorCodeRejected {
+		t.Errorf("resetting an unknown zone gave %v, want it rejected", missing)
+	}
+	if empty == nil || empty.Code != ErrorCodeInvalidPayload {
+		t.Errorf("resetting without a zone gave %v, want an invalid payload", empty)
+	}
+	if resetErr != nil {
+		t.Fatalf("reset failed: %v", resetErr.Message)
+	}
+	if before == 0 || covered != 0 {
+		t.Errorf("%v%% covered before the reset and %v%% after, want some then none", before, covered)
+	}
+}
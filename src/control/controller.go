@@ -3,14 +3,15 @@ package control
 import (
 	"encoding/json"
 	//"fmt"
-	"log"
 	"math"
-	"net/http"
+	"reflect"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/dchote/robot-mower/src/auth"
+	"github.com/dchote/robot-mower/src/config"
 	"github.com/dchote/robot-mower/src/control/drivers"
+	"github.com/dchote/robot-mower/src/logger"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo"
@@ -29,93 +30,269 @@ import (
 )
 
 const (
-	publishInterval = 1000 * time.Millisecond
+	defaultPublishInterval = 1000 * time.Millisecond
+	navigationInterval     = 100 * time.Millisecond
+	imuInterval            = 125 * time.Millisecond
+
+	// work queued for the controller loop by the hardware loops before it blocks them
+	actionQueueSize = 64
 )
 
+// MowerControllerStruct and MowerState are owned by the controller loop, every other goroutine hands it work through Post or Do
 type MowerControllerStruct struct {
 	wsClients    map[*wsClientStruct]bool
 	wsRegister   chan *wsClientStruct
 	wsUnregister chan *wsClientStruct
-	wsCommands   chan []byte
+	wsCommands   chan wsCommandStruct
+
+	actions chan func()
 
-	wsPublishTicker *time.Ticker
+	wsPublishTicker      *time.Ticker
+	wsSubscriptionTicker *time.Ticker
 
 	robotPlatform *gobot.Robot
 
 	mpuData *drivers.MPUData
+
+	pathFollower *PathFollowerStruct
+	job          *JobStruct
+	coverage     map[string]*CoverageMapStruct
+	docking      *dockingStruct
+	drive        *driveStruct
+
+	powerMonitors   []*powerMonitorStruct
+	batteryModel    *BatteryModelStruct
+	batteryHealth   *BatteryHistoryStruct
+	batteryHistory  []batterySample
+	lowBatteryJobID string
+
+	protectionRules []*protectionRuleStruct
+
+	// what the event log has last seen, so each transition is recorded once
+	lastMode       string
+	lastDockStatus string
+	outsideZone    bool
+
+	lease        *leaseStruct
+	nextClientID int
+
+	// the session being recorded, nil when the recorder is off
+	recorder *recorderStruct
 }
 
 type wsClientStruct struct {
 	controller *MowerControllerStruct
 	conn       *websocket.Conn
 	send       chan []byte
+
+	identity ControllerIdentity
+
+	// 0 until the client says hello, older clients never do
+	protocolVersion int
+
+	// clients with subscriptions only get the topics they asked for instead of the full state every second
+	subscriptions map[string]*subscriptionStruct
+}
+
+type wsCommandStruct struct {
+	client  *wsClientStruct
+	message []byte
 }
 
 var (
-	wsUpgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
-		return true
-	}}
+	wsUpgrader = websocket.Upgrader{CheckOrigin: auth.OriginAllowed}
 
 	MowerController *MowerControllerStruct
+
+	log = logger.New("control")
+	// the state goes out every second and the IMU is read many times a second, at debug level these would flood the SD card
+	stateLog   = log.Sampled(10 * time.Second)
+	imuLog     = log.Sampled(time.Second)
+	headingLog = log.Sampled(time.Second)
+	// a disconnected thermistor fails every read
+	temperatureLog = log.Sampled(time.Minute)
 )
 
 func StartController() {
 	// build default state
 	MowerState = new(MowerStateStruct)
 
-	// initialize the hardware platform devices
-	r := raspi.NewAdaptor()
-	ina := drivers.NewINA219Driver(r)
+	// initialize the hardware platform devices, a replay stands in for all of them
+	var connections []gobot.Connection
+	var devices []gobot.Device
+	var powerMonitors []*powerMonitorStruct
+	var imu *drivers.MPU9250Driver
+	var thermistor *drivers.ADS1115Driver
+	if replaying == nil {
+		r := raspi.NewAdaptor()
+		connections = append(connections, r)
+		powerMonitors = NewPowerMonitors(r)
+		imu = drivers.NewMPU9250Driver(r)
+		devices = append(powerDevices(powerMonitors), imu)
+
+		if thermistor = NewBatteryThermistor(r); thermistor != nil {
+			devices = append(devices, thermistor)
+		}
+	}
 
 	robotWork := func() {
-		// we will want to sample our IMU at ~8hz (125ms) ALL i2c devices need to be read in here
-		gobot.Every(1000*time.Millisecond, func() {
-			// read voltage and current
-			val, err := ina.GetLoadVoltage()
-			if err == nil {
-				MowerState.Battery.Voltage = math.Round(val*100) / 100
-			}
-			val, err = ina.GetCurrent()
-			if err == nil {
-				MowerState.Battery.Current = math.Round(val*100) / 100
-			}
+		if replaying != nil {
+			go replaying.run()
+		} else {
+			// ALL i2c devices need to be read in here,
+			// only the readings are handed over to the controller loop so a slow bus never stalls it
+			gobot.Every(1000*time.Millisecond, func() {
+				// read voltage and current
+				power := ReadPowerMonitors()
+
+				// and the pack temperature when there is a thermistor
+				var temperature *float64
+				if thermistor != nil {
+					if celsius, err := ReadBatteryTemperature(thermistor); err == nil {
+						temperature = &celsius
+					} else {
+						temperatureLog.Warnf("unable to read the battery temperature: %v", err)
+					}
+				}
+
+				Post(func() {
+					if temperature != nil {
+						SetBatteryTemperature(*temperature)
+					}
+					UpdatePower(power)
+				})
+			})
+
+			gobot.Every(imuInterval, func() {
+				if err := imu.GetData(); err != nil {
+					imuLog.Debugf("unable to read the IMU: %v", err)
+					return
+				}
 
+				// the driver fills in its reading in place, the loop gets a copy of it
+				data := *imu.Data
+
+				Post(func() {
+					SetIMUValues(&data)
+				})
+			})
+		}
+
+		gobot.Every(navigationInterval, func() {
+			Post(func() {
+				UpdateNavigation()
+				UpdateGeofence()
+				UpdateDocking()
+				UpdateDrive()
+				UpdateCoverage()
+				UpdateJobDistance()
+			})
 		})
 	}
 
 	InitMowerState()
 	InitFilters()
-	UpdateSystemState()
+
+	// before anything can record an event
+	StartEvents()
 
 	// mower controller
 	MowerController = &MowerControllerStruct{
 		wsClients:    make(map[*wsClientStruct]bool),
 		wsRegister:   make(chan *wsClientStruct),
 		wsUnregister: make(chan *wsClientStruct),
-		wsCommands:   make(chan []byte),
+		wsCommands:   make(chan wsCommandStruct),
+
+		actions: make(chan func(), actionQueueSize),
 
-		wsPublishTicker: time.NewTicker(publishInterval),
+		coverage: make(map[string]*CoverageMapStruct),
+		drive:    &driveStruct{},
+
+		powerMonitors: powerMonitors,
+		batteryModel:  NewBatteryModel(),
+		batteryHealth: LoadBatteryHistory(),
+
+		protectionRules: NewProtectionRules(),
+
+		wsPublishTicker:      time.NewTicker(publishInterval()),
+		wsSubscriptionTicker: time.NewTicker(subscriptionInterval),
 
 		robotPlatform: gobot.NewRobot("Mower",
-			[]gobot.Connection{r},
-			[]gobot.Device{ina},
+			connections,
+			devices,
 			robotWork),
 	}
 
+	// pick up a job that was interrupted by a reboot, or the one the replayed recording started with
+	if replaying != nil {
+		replaying.restore()
+	} else {
+		LoadJob()
+	}
+
+	startRecording()
+
+	config.OnChange(configChanged)
+
 	time.Sleep(1 * time.Second)
 
 	// start the robotPlatform loop
 	go MowerController.robotPlatform.Start()
 
-	// websocket client transmit/recieve loop
+	// controller loop, also the websocket client transmit/recieve loop
 	go MowerController.wsClientLoop()
 
-	// websocket client data publishing loop, this will live elsewhere
-	go wsPublishLoop()
+	// marks the reboots in the event log
+	Post(func() {
+		RecordEvent(EventSeverityInfo, EventTypeSystem, "controller started", nil)
+	})
+
+	// platform stats take a couple of seconds to sample so they are gathered on their own loop
+	go systemStateLoop()
+}
+
+// Post queues fn to run on the controller loop without waiting for it
+func Post(fn func()) {
+	if MowerController == nil {
+		log.Errorf("controller is not running, dropping queued work")
+		return
+	}
+
+	MowerController.actions <- fn
+}
+
+// Do runs fn on the controller loop and waits for it to finish, it is for other goroutines only, code on the loop calls what it needs directly
+func Do(fn func()) {
+	if MowerController == nil {
+		log.Errorf("controller is not running, dropping work")
+		return
+	}
+
+	done := make(chan bool)
+	MowerController.actions <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// State returns a copy of the published state, the maps and slices in it are replaced rather than modified so the copy stays consistent
+func State() MowerStateStruct {
+	var state MowerStateStruct
+	Do(func() {
+		state = *MowerState
+	})
+
+	return state
 }
 
 func StopController() {
 	MowerController.robotPlatform.Stop()
+
+	Do(func() {
+		stopRecording()
+		flushEvents()
+	})
 }
 
 func InitMowerState() {
@@ -125,8 +302,8 @@ func InitMowerState() {
 	MowerState.Platform.Platform = sysInfo.Platform
 
 	MowerState.Battery.Status = "Unknown"
-	MowerState.Battery.VoltageNominal = 24.0
-	MowerState.Battery.VoltageWarn = 22.0 // TODO figure out the exact value this needs to be
+	setBatteryVoltages()
+	MowerState.Battery.RemainingRuntime = -1
 	MowerState.Battery.Voltage = 23.5
 	MowerState.Battery.Current = 0.1
 
@@ -140,70 +317,207 @@ func InitMowerState() {
 	MowerState.Drive.Direction = "stopped"
 
 	MowerState.Cutter.Speed = 0
+
+	MowerState.Navigation.Status = "idle"
+
+	MowerState.Mode = ModeManual
+
+	MowerState.Dock.Status = DockStatusIdle
 }
 
+// UpdateSystemState samples the platform stats, the sampling is slow so it runs off the controller loop and only the results are posted to it
 func UpdateSystemState() {
-	MowerState.Platform.CPULoad.Count, _ = cpu.Counts(false)
+	var sample MowerStateStruct
+	platform := &sample.Platform
+
+	platform.CPULoad.Count, _ = cpu.Counts(false)
 
-	cpuLoad, _ := cpu.Percent(publishInterval, false)
-	MowerState.Platform.CPULoad.Total = cpuLoad[0]
+	cpuLoad, _ := cpu.Percent(publishInterval(), false)
+	platform.CPULoad.Total = cpuLoad[0]
 
-	perCPU, _ := cpu.Percent(publishInterval, true)
+	perCPU, _ := cpu.Percent(publishInterval(), true)
 	// TODO do this better, this is a hax but I dont know the right way to do it right now.
-	MowerState.Platform.CPULoad.Core1 = perCPU[0]
-	if MowerState.Platform.CPULoad.Count >= 2 {
-		MowerState.Platform.CPULoad.Core2 = perCPU[1]
+	platform.CPULoad.Core1 = perCPU[0]
+	if platform.CPULoad.Count >= 2 {
+		platform.CPULoad.Core2 = perCPU[1]
 	}
-	if MowerState.Platform.CPULoad.Count >= 3 {
-		MowerState.Platform.CPULoad.Core3 = perCPU[2]
+	if platform.CPULoad.Count >= 3 {
+		platform.CPULoad.Core3 = perCPU[2]
 	}
-	if MowerState.Platform.CPULoad.Count >= 4 {
-		MowerState.Platform.CPULoad.Core4 = perCPU[3]
+	if platform.CPULoad.Count >= 4 {
+		platform.CPULoad.Core4 = perCPU[3]
 	}
-	if MowerState.Platform.CPULoad.Count >= 5 {
-		MowerState.Platform.CPULoad.Core5 = perCPU[4]
+	if platform.CPULoad.Count >= 5 {
+		platform.CPULoad.Core5 = perCPU[4]
 	}
-	if MowerState.Platform.CPULoad.Count >= 6 {
-		MowerState.Platform.CPULoad.Core6 = perCPU[5]
+	if platform.CPULoad.Count >= 6 {
+		platform.CPULoad.Core6 = perCPU[5]
 	}
-	if MowerState.Platform.CPULoad.Count >= 7 {
-		MowerState.Platform.CPULoad.Core7 = perCPU[6]
+	if platform.CPULoad.Count >= 7 {
+		platform.CPULoad.Core7 = perCPU[6]
 	}
-	if MowerState.Platform.CPULoad.Count >= 8 {
-		MowerState.Platform.CPULoad.Core8 = perCPU[7]
+	if platform.CPULoad.Count >= 8 {
+		platform.CPULoad.Core8 = perCPU[7]
 	}
 
 	loadInfo, _ := load.Avg()
-	MowerState.Platform.LoadAverage.Load1 = loadInfo.Load1
-	MowerState.Platform.LoadAverage.Load5 = loadInfo.Load5
-	MowerState.Platform.LoadAverage.Load15 = loadInfo.Load15
+	platform.LoadAverage.Load1 = loadInfo.Load1
+	platform.LoadAverage.Load5 = loadInfo.Load5
+	platform.LoadAverage.Load15 = loadInfo.Load15
 
 	memInfo, _ := mem.VirtualMemory()
-	MowerState.Platform.MemoryUsage.Total = memInfo.Total
-	MowerState.Platform.MemoryUsage.Available = memInfo.Available
+	platform.MemoryUsage.Total = memInfo.Total
+	platform.MemoryUsage.Available = memInfo.Available
 
 	diskInfo, _ := disk.Usage("/")
-	MowerState.Platform.DiskUsage.Total = diskInfo.Total
-	MowerState.Platform.DiskUsage.Free = diskInfo.Free
+	platform.DiskUsage.Total = diskInfo.Total
+	platform.DiskUsage.Free = diskInfo.Free
+
+	Post(func() {
+		MowerState.Platform.CPULoad = platform.CPULoad
+		MowerState.Platform.LoadAverage = platform.LoadAverage
+		MowerState.Platform.MemoryUsage = platform.MemoryUsage
+		MowerState.Platform.DiskUsage = platform.DiskUsage
+	})
 }
 
-func wsPublishLoop() {
-	for {
-		select {
-		case <-MowerController.wsPublishTicker.C:
-			UpdateSystemState()
-			wsPublishState()
+// SetPose updates the localized pose used by the path follower
+func SetPose(pose Pose) {
+	record(RecordPose, pose)
+
+	MowerState.Pose = pose
+}
+
+// FollowPath starts tracking the supplied waypoints from the current pose, replacing any active path
+func FollowPath(waypoints []Waypoint) {
+	MowerController.pathFollower = NewPathFollower(waypoints)
+
+	MowerState.Navigation.Status = "following"
+	MowerState.Navigation.Waypoint = 0
+	MowerState.Navigation.WaypointCount = len(waypoints)
+	MowerState.Navigation.CrossTrackError = 0
+	MowerState.Navigation.Command = VelocityCommand{}
+}
+
+// StopPath abandons the active path and zeroes the velocity command
+func StopPath() {
+	MowerController.pathFollower = nil
+
+	MowerState.Navigation.Status = "stopped"
+	MowerState.Navigation.Command = VelocityCommand{}
+}
+
+func UpdateNavigation() {
+	follower := MowerController.pathFollower
+	if follower == nil {
+		return
+	}
+
+	MowerState.Navigation.Command = follower.Update(MowerState.Pose)
+	MowerState.Navigation.Waypoint = follower.CurrentWaypoint()
+	MowerState.Navigation.CrossTrackError = math.Round(follower.CrossTrackError()*1000) / 1000
+
+	updateJobProgress(follower)
+
+	if follower.Arrived() {
+		MowerController.pathFollower = nil
+		MowerState.Navigation.Status = "arrived"
+	}
+}
+
+// configChanged picks up the settings that are copied into controller state rather than read from the config each time
+func configChanged(old *config.ConfigStruct, cfg *config.ConfigStruct) {
+	Post(func() {
+		if !reflect.DeepEqual(old.Protection, cfg.Protection) {
+			ReloadProtectionRules()
+		}
+
+		if old.Navigation != cfg.Navigation && MowerController.pathFollower != nil {
+			MowerController.pathFollower.Configure()
+		}
+
+		if old.Battery.VoltageNominal != cfg.Battery.VoltageNominal || old.Battery.VoltageWarn != cfg.Battery.VoltageWarn {
+			setBatteryVoltages()
+		}
+
+		if old.Recorder.Enabled != cfg.Recorder.Enabled {
+			if cfg.Recorder.Enabled {
+				startRecording()
+			} else {
+				stopRecording()
+			}
 		}
+
+		if old.Control.PublishInterval != cfg.Control.PublishInterval {
+			MowerController.wsPublishTicker.Stop()
+			MowerController.wsPublishTicker = time.NewTicker(publishInterval())
+		}
+
+		// the published expiry follows a new lease timeout
+		updateControlState()
+	})
+}
+
+// setBatteryVoltages publishes the nominal and warning voltages from config.json
+func setBatteryVoltages() {
+	cfg := config.Current()
+
+	MowerState.Battery.VoltageNominal = defaultVoltageNominal
+	if cfg.Battery.VoltageNominal > 0 {
+		MowerState.Battery.VoltageNominal = cfg.Battery.VoltageNominal
+	}
+	MowerState.Battery.VoltageWarn = defaultVoltageWarn
+	if cfg.Battery.VoltageWarn > 0 {
+		MowerState.Battery.VoltageWarn = cfg.Battery.VoltageWarn
+	}
+}
+
+func publishInterval() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Control.PublishInterval > 0 {
+		return time.Duration(cfg.Control.PublishInterval) * time.Millisecond
+	}
+
+	return defaultPublishInterval
+}
+
+func systemStateLoop() {
+	// sampling already takes longer than the interval, the ticker only paces us when sampling fails fast
+	ticker := time.NewTicker(publishInterval())
+
+	for {
+		UpdateSystemState()
+		<-ticker.C
 	}
 }
 
 func wsPublishState() {
-	//log.Println("publishing state")
+	//log.Infof("publishing state")
+
+	wsBroadcast(Envelope{Type: MessageTypeState, Topic: TopicState, Payload: MowerState},
+		StateMessage{MowerStateStruct: MowerState, Namespace: "mower", Mutation: "setMowerState"})
+}
+
+// wsBroadcast sends a message to every connected client in the protocol version it negotiated, dropping any client that is not keeping up
+func wsBroadcast(envelope Envelope, legacy interface{}) {
+	envelope.Version = ProtocolVersion
+	current, _ := json.Marshal(envelope)
+	previous, _ := json.Marshal(legacy)
 
-	message, _ := json.Marshal(StateMessage{MowerStateStruct: MowerState, Namespace: "mower", Mutation: "setMowerState"})
-	log.Println("state: " + string(message))
+	if envelope.Type == MessageTypeState {
+		stateLog.Debugf("state: %s", previous)
+	}
 
 	for client := range MowerController.wsClients {
+		message := previous
+		if client.protocolVersion > 0 {
+			message = current
+		}
+		if envelope.Type == MessageTypeState && len(client.subscriptions) > 0 {
+			continue
+		}
+
 		select {
 		case client.send <- message:
 		default:
@@ -213,48 +527,197 @@ func wsPublishState() {
 	}
 }
 
+// wsClientLoop is the controller loop, the only goroutine that touches MowerState, the controller or the websocket clients
 func (m *MowerControllerStruct) wsClientLoop() {
 	for {
 		select {
+		case action := <-m.actions:
+			action()
+			checkTransitions()
+		case <-m.wsPublishTicker.C:
+			checkControlLease()
+			wsPublishState()
+			recordState()
 		case client := <-m.wsRegister:
+			m.nextClientID++
+			client.identity.ID = "ws-" + strconv.Itoa(m.nextClientID)
 			m.wsClients[client] = true
 		case client := <-m.wsUnregister:
 			if _, ok := m.wsClients[client]; ok {
 				delete(m.wsClients, client)
 				close(client.send)
 			}
-		case message := <-m.wsCommands:
-			// handle the command message
-			log.Println("command: " + string(message))
+			clientDisconnected(client.identity)
+		case command := <-m.wsCommands:
+			// we want to stay in this processing loop, so never return out
+			log.Debugf("command: %s", command.message)
 
-			var commandMessage CommandMessage
-			err := json.Unmarshal(message, &commandMessage)
-			if err != nil {
-				log.Println("error decoding json")
-			} else {
-				// we want to stay in this processing loop, so never return out
-
-				if strings.Compare(commandMessage.Method, "setMowerDriveSpeed") == 0 {
-					MowerState.Drive.Speed, _ = strconv.Atoi(commandMessage.Value)
-				} else if strings.Compare(commandMessage.Method, "setMowerCutterSpeed") == 0 {
-					MowerState.Cutter.Speed, _ = strconv.Atoi(commandMessage.Value)
-				} else if strings.Compare(commandMessage.Method, "requestDirectionStart") == 0 {
-					// TODO actual callout logic, right now we'll just update state
-					MowerState.Drive.Direction = commandMessage.Value
-				} else if strings.Compare(commandMessage.Method, "requestDirectionStop") == 0 {
-					// TODO actual callout logic, right now we'll just update state
-					MowerState.Drive.Direction = "stopped"
-				}
+			m.handleMessage(command.client, command.message)
+			checkTransitions()
 
-				// send updated state immediately
-				go wsPublishState()
-			}
+			// send updated state immediately
+			wsPublishState()
+		case <-m.wsSubscriptionTicker.C:
+			m.wsPublishSubscriptions()
+		}
+	}
+}
+
+// handleMessage answers a hello or runs a command, messages without a version are version 0 commands from older clients
+func (m *MowerControllerStruct) handleMessage(client *wsClientStruct, message []byte) {
+	var envelope incomingEnvelope
+	err := json.Unmarshal(message, &envelope)
+	if err != nil {
+		log.Warnf("error decoding json")
+		m.wsReply(client, Envelope{Type: MessageTypeError, Error: &ProtocolError{Code: ErrorCodeBadRequest, Message: err.Error()}})
+		return
+	}
+
+	if envelope.Version == 0 {
+		var commandMessage CommandMessage
+		json.Unmarshal(message, &commandMessage)
+
+		if err := executeLegacyCommand(client.identity, commandMessage); err != nil {
+			log.Warnf("command %v failed: %v", commandMessage.Method, err)
+			m.wsReplyLegacy(client, CommandErrorMessage{Method: commandMessage.Method, Error: err, Namespace: "mower", Mutation: "setCommandError"})
+		}
+		return
+	}
+
+	if !protocolVersionSupported(envelope.Version) {
+		m.wsReply(client, Envelope{Type: MessageTypeError, ID: envelope.ID, Error: &ProtocolError{
+			Code:    ErrorCodeUnsupportedVersion,
+			Message: "protocol version " + strconv.Itoa(envelope.Version) + " is not supported",
+		}})
+		return
+	}
+
+	switch envelope.Type {
+	case MessageTypeHello:
+		var hello HelloPayload
+		if len(envelope.Payload) > 0 {
+			json.Unmarshal(envelope.Payload, &hello)
 		}
+
+		client.protocolVersion = negotiateProtocolVersion(envelope.Version, hello.Versions)
+		client.identity.Name = hello.Client
+		log.Debugf("WebSocket: %v speaks protocol version %v", describeIdentity(client.identity), client.protocolVersion)
+
+		m.wsReply(client, Envelope{Type: MessageTypeWelcome, ID: envelope.ID, Payload: CapabilitiesStruct{
+			Version:  client.protocolVersion,
+			Versions: supportedProtocolVersions,
+			Name:     config.Current().Mower.Name,
+			Methods:  CommandMethods(),
+			Topics:   TopicNames(),
+			Events:   []string{TopicProtection, TopicControl, TopicEvents},
+			Identity: client.identity,
+		}})
+	case MessageTypeCommand:
+		// a client that skipped the hello still gets replies in the version it used
+		if client.protocolVersion == 0 {
+			client.protocolVersion = envelope.Version
+		}
+
+		result, err := ExecuteCommand(client.identity, envelope.Method, envelope.Payload)
+		if err != nil {
+			log.Warnf("command %v failed: %v", envelope.Method, err)
+			m.wsReply(client, Envelope{Type: MessageTypeError, ID: envelope.ID, Method: envelope.Method, Error: err})
+			return
+		}
+
+		m.wsReply(client, Envelope{Type: MessageTypeAck, ID: envelope.ID, Method: envelope.Method, Payload: result})
+	case MessageTypeSubscribe, MessageTypeUnsubscribe:
+		if client.protocolVersion == 0 {
+			client.protocolVersion = envelope.Version
+		}
+
+		var payload SubscribePayload
+		err := json.Unmarshal(envelope.Payload, &payload)
+		if err == nil {
+			err = payload.Validate()
+		}
+		if err != nil {
+			m.wsReply(client, Envelope{Type: MessageTypeError, ID: envelope.ID, Error: &ProtocolError{Code: ErrorCodeInvalidPayload, Message: err.Error()}})
+			return
+		}
+
+		if envelope.Type == MessageTypeSubscribe {
+			client.subscribe(&payload)
+		} else {
+			client.unsubscribe(&payload)
+		}
+
+		m.wsReply(client, Envelope{Type: MessageTypeAck, ID: envelope.ID, Payload: SubscribePayload{Topics: client.activeSubscriptions()}})
+	default:
+		m.wsReply(client, Envelope{Type: MessageTypeError, ID: envelope.ID, Error: &ProtocolError{
+			Code:    ErrorCodeBadRequest,
+			Message: "unknown message type " + envelope.Type,
+		}})
+	}
+}
+
+// wsReply sends a message to a single client, it must only be called from the controller loop
+func (m *MowerControllerStruct) wsReply(client *wsClientStruct, envelope Envelope) {
+	if _, ok := m.wsClients[client]; !ok {
+		return
+	}
+
+	envelope.Version = client.protocolVersion
+	if envelope.Version == 0 {
+		envelope.Version = ProtocolVersion
+	}
+	message, _ := json.Marshal(envelope)
+
+	m.wsSend(client, message)
+}
+
+// wsReplyLegacy sends a version 0 message to one client
+func (m *MowerControllerStruct) wsReplyLegacy(client *wsClientStruct, legacy interface{}) {
+	if _, ok := m.wsClients[client]; !ok {
+		return
+	}
+
+	message, _ := json.Marshal(legacy)
+
+	m.wsSend(client, message)
+}
+
+func (m *MowerControllerStruct) wsSend(client *wsClientStruct, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		close(client.send)
+		delete(m.wsClients, client)
+	}
+}
+
+func protocolVersionSupported(version int) bool {
+	for _, v := range supportedProtocolVersions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateProtocolVersion picks the newest version both sides speak, falling back to the version the hello was sent in
+func negotiateProtocolVersion(version int, offered []int) int {
+	best := 0
+	for _, v := range offered {
+		if v > best && protocolVersionSupported(v) {
+			best = v
+		}
+	}
+	if best == 0 {
+		best = version
 	}
+
+	return best
 }
 
 func WebSocketConnection(c echo.Context) error {
-	log.Println("WebSocket: " + c.RealIP() + " connected")
+	log.Infof("WebSocket: %v connected", c.RealIP())
 
 	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
@@ -262,6 +725,11 @@ func WebSocketConnection(c echo.Context) error {
 	}
 
 	client := &wsClientStruct{controller: MowerController, conn: conn, send: make(chan []byte, 256)}
+	client.identity.Address = c.RealIP()
+	if principal, ok := c.Get(auth.ContextKey).(*auth.Principal); ok {
+		client.identity.User = principal.Name
+		client.identity.Role = principal.Role
+	}
 	client.controller.wsRegister <- client
 
 	go client.writeWebSocket()
@@ -281,12 +749,12 @@ func (c *wsClientStruct) readWebSocket() {
 
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				log.Warnf("WebSocket: %v", err)
 			}
 			break
 		}
 
-		c.controller.wsCommands <- message
+		c.controller.wsCommands <- wsCommandStruct{client: c, message: message}
 	}
 }
 
@@ -0,0 +1,180 @@
+package control
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+var (
+	testDataDirectory string
+	testStart         sync.Once
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mower-control")
+	if err != nil {
+		panic(err)
+	}
+	testDataDirectory = dir
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startTestController runs the controller loop without any hardware, on the defaults and a temporary data directory
+func startTestController(t *testing.T) {
+	testStart.Do(func() {
+		file := filepath.Join(testDataDirectory, "config.json")
+		data := `{"mower": {"dataDirectory": "` + testDataDirectory + `"}, "control": {"publishInterval": 100}}`
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.LoadConfig(file, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		MowerState = new(MowerStateStruct)
+		InitMowerState()
+		StartEvents()
+
+		MowerController = &MowerControllerStruct{
+			wsClients:    make(map[*wsClientStruct]bool),
+			wsRegister:   make(chan *wsClientStruct),
+			wsUnregister: make(chan *wsClientStruct),
+			wsCommands:   make(chan wsCommandStruct),
+
+			actions: make(chan func(), actionQueueSize),
+
+			coverage: make(map[string]*CoverageMapStruct),
+			drive:    &driveStruct{},
+
+			batteryModel:  NewBatteryModel(),
+			batteryHealth: &BatteryHistoryStruct{},
+
+			wsPublishTicker:      time.NewTicker(publishInterval()),
+			wsSubscriptionTicker: time.NewTicker(subscriptionInterval),
+		}
+
+		go MowerController.wsClientLoop()
+	})
+}
+
+// connectTestClient registers a websocket client that reads everything sent to it until it is unregistered
+func connectTestClient() *wsClientStruct {
+	client := &wsClientStruct{controller: MowerController, send: make(chan []byte, 256)}
+	MowerController.wsRegister <- client
+
+	go func() {
+		for range client.send {
+		}
+	}()
+
+	return client
+}
+
+// runs before anything starts the controller, MowerController is still nil
+func TestDoWithoutController(t *testing.T) {
+	if MowerController != nil {
+		t.Skip("the controller is already running")
+	}
+
+	ran := false
+	Do(func() { ran = true })
+	Post(func() { ran = true })
+	State()
+
+	if ran {
+		t.Fatal("work ran without a controller")
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	startTestController(t)
+
+	messages := []string{
+		`{"v": 1, "type": "hello", "id": "1", "payload": {"client": "test", "versions": [1]}}`,
+		`{"v": 1, "type": "subscribe", "id": "2", "payload": {"topics": [{"topic": "battery", "rate": 20}, {"topic": "imu"}]}}`,
+		`{"v": 1, "type": "command", "id": "3", "method": "setMowerDriveSpeed", "payload": {"speed": 50}}`,
+		`{"v": 1, "type": "unsubscribe", "id": "4", "payload": {"topics": [{"topic": "battery"}]}}`,
+		`{"method": "requestDirectionStop"}`,
+		`not json`,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 25; j++ {
+				client := connectTestClient()
+
+				for _, message := range messages {
+					MowerController.wsCommands <- wsCommandStruct{client: client, message: []byte(message)}
+				}
+
+				Post(func() {
+					MowerState.Battery.Voltage = 24 + float64(j)/10
+				})
+				Do(func() {
+					wsBroadcast(Envelope{Type: MessageTypeEvent, Topic: TopicEvents, Payload: "client " + strconv.Itoa(i)}, nil)
+				})
+
+				if state := State(); state.Mode == "" {
+					t.Error("State returned an empty mode")
+				}
+
+				MowerController.wsUnregister <- client
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var clients int
+	Do(func() { clients = len(MowerController.wsClients) })
+	if clients != 0 {
+		t.Fatalf("%v clients left registered, want 0", clients)
+	}
+}
+
+func TestLegacyCommandRefused(t *testing.T) {
+	startTestController(t)
+
+	client := &wsClientStruct{controller: MowerController, send: make(chan []byte, 256)}
+	MowerController.wsRegister <- client
+	defer func() { MowerController.wsUnregister <- client }()
+
+	Do(func() { MowerState.Protection.Level = ProtectionLevelCutter })
+	defer Do(func() { MowerState.Protection.Level = ProtectionLevelNone })
+
+	MowerController.wsCommands <- wsCommandStruct{client: client, message: []byte(`{"method": "setMowerCutterSpeed", "value": "80"}`)}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case message := <-client.send:
+			var reply CommandErrorMessage
+			json.Unmarshal(message, &reply)
+			if reply.Mutation != "setCommandError" {
+				continue
+			}
+
+			if reply.Method != "setMowerCutterSpeed" || reply.Error == nil {
+				t.Fatalf("refusal %s, want the cutter command and why", message)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no error frame for the refused command")
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	defaultCoverageCellSize = 0.1
+	defaultCutterWidth      = 0.3
+
+	// margin around the zone so a cutter overhanging the boundary is still recorded
+	coverageMargin = 0.5
+
+	coverageDirectory    = "coverage"
+	coverageSaveInterval = 30 * time.Second
+)
+
+var (
+	coveredColor   = color.NRGBA{R: 0x4c, G: 0xaf, B: 0x50, A: 0xb0}
+	uncoveredColor = color.NRGBA{R: 0xf4, G: 0x43, B: 0x36, A: 0x80}
+
+	unsafeZoneName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// CoverageMapStruct is a grid over a zone where each cell records whether the cutter has passed over it
+type CoverageMapStruct struct {
+	Zone     Zone    `json:"zone"`
+	OriginX  float64 `json:"origin_x"`
+	OriginY  float64 `json:"origin_y"`
+	CellSize float64 `json:"cell_size"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Cells    []byte  `json:"cells"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+
+	dirty     bool
+	savedAt   time.Time
+	lastPose  *Pose
+	zoneCells []bool
+}
+
+// NewCoverageMap creates an empty grid covering the zone boundary, falling back to the plan extent for zones without one
+func NewCoverageMap(zone Zone, plan []Waypoint) (*CoverageMapStruct, error) {
+	cfg := config.Current()
+
+	points := zone.Boundary
+	if len(points) < 3 {
+		points = plan
+	}
+	if len(points) == 0 {
+		return nil, errors.New("zone " + zone.Name + " has no boundary or plan to size the coverage map from")
+	}
+
+	cellSize := defaultCoverageCellSize
+	if cfg != nil && cfg.Coverage.CellSize > 0 {
+		cellSize = cfg.Coverage.CellSize
+	}
+
+	minX, minY, maxX, maxY := points[0].X, points[0].Y, points[0].X, points[0].Y
+	for _, p := range points {
+		minX = math.Min(minX, p.X)
+		minY = math.Min(minY, p.Y)
+		maxX = math.Max(maxX, p.X)
+		maxY = math.Max(maxY, p.Y)
+	}
+
+	m := &CoverageMapStruct{
+		Zone:     zone,
+		OriginX:  minX - coverageMargin,
+		OriginY:  minY - coverageMargin,
+		CellSize: cellSize,
+		Width:    int(math.Ceil((maxX-minX+2*coverageMargin)/cellSize)) + 1,
+		Height:   int(math.Ceil((maxY-minY+2*coverageMargin)/cellSize)) + 1,
+	}
+	m.Cells = make([]byte, m.Width*m.Height)
+
+	return m, nil
+}
+
+// Sweep marks every cell within half a cutter width of the line between the previous and current pose, returning how many were not covered before
+func (m *CoverageMapStruct) Sweep(pose Pose) (newlyCovered int) {
+	from := pose
+	if m.lastPose != nil {
+		from = *m.lastPose
+	}
+	m.lastPose = &pose
+
+	radius := cutterWidth() / 2
+
+	minCol, minRow := m.cellAt(math.Min(from.X, pose.X)-radius, math.Min(from.Y, pose.Y)-radius)
+	maxCol, maxRow := m.cellAt(math.Max(from.X, pose.X)+radius, math.Max(from.Y, pose.Y)+radius)
+
+	start := Waypoint{X: from.X, Y: from.Y}
+	end := Waypoint{X: pose.X, Y: pose.Y}
+
+	for row := maxInt(minRow, 0); row <= minInt(maxRow, m.Height-1); row++ {
+		for col := maxInt(minCol, 0); col <= minInt(maxCol, m.Width-1); col++ {
+			x, y := m.cellCenter(col, row)
+			closest, _ := projectOntoSegment(Pose{X: x, Y: y}, start, end)
+			if distance(x, y, closest.X, closest.Y) <= radius && m.Cells[row*m.Width+col] == 0 {
+				m.Cells[row*m.Width+col] = 1
+				m.dirty = true
+				newlyCovered++
+			}
+		}
+	}
+
+	if m.dirty {
+		m.UpdatedAt = time.Now()
+	}
+
+	return newlyCovered
+}
+
+// BreakTrajectory stops the next sweep from joining up with the last recorded pose, e.g. after the cutter was off
+func (m *CoverageMapStruct) BreakTrajectory() {
+	m.lastPose = nil
+}
+
+// PercentCovered is the share of cells inside the zone boundary that have been mowed
+func (m *CoverageMapStruct) PercentCovered() float64 {
+	inside, covered := 0, 0
+	for i, in := range m.insideZone() {
+		if in {
+			inside++
+			if m.Cells[i] != 0 {
+				covered++
+			}
+		}
+	}
+
+	if inside == 0 {
+		return 0
+	}
+
+	return 100 * float64(covered) / float64(inside)
+}
+
+// GapPlan builds a serpentine path through every uncovered run of cells inside the zone, row spacing is one cutter width
+func (m *CoverageMapStruct) GapPlan() []Waypoint {
+	inside := m.insideZone()
+	step := maxInt(int(cutterWidth()/m.CellSize), 1)
+
+	var plan []Waypoint
+	reverse := false
+	for row := step / 2; row < m.Height; row += step {
+		var runs [][2]int
+		start := -1
+		for col := 0; col <= m.Width; col++ {
+			missed := col < m.Width && inside[row*m.Width+col] && !m.coveredNear(col, row, step/2)
+			if missed && start < 0 {
+				start = col
+			} else if !missed && start >= 0 {
+				runs = append(runs, [2]int{start, col - 1})
+				start = -1
+			}
+		}
+
+		if reverse {
+			for i := len(runs) - 1; i >= 0; i-- {
+				x1, y := m.cellCenter(runs[i][1], row)
+				x2, _ := m.cellCenter(runs[i][0], row)
+				plan = append(plan, Waypoint{X: x1, Y: y}, Waypoint{X: x2, Y: y})
+			}
+		} else {
+			for _, run := range runs {
+				x1, y := m.cellCenter(run[0], row)
+				x2, _ := m.cellCenter(run[1], row)
+				plan = append(plan, Waypoint{X: x1, Y: y}, Waypoint{X: x2, Y: y})
+			}
+		}
+
+		if len(runs) > 0 {
+			reverse = !reverse
+		}
+	}
+
+	return plan
+}
+
+// Image renders covered cells green and missed cells inside the zone red, north (+Y) is up
+func (m *CoverageMapStruct) Image() image.Image {
+	inside := m.insideZone()
+	img := image.NewNRGBA(image.Rect(0, 0, m.Width, m.Height))
+
+	for row := 0; row < m.Height; row++ {
+		for col := 0; col < m.Width; col++ {
+			i := row*m.Width + col
+			if m.Cells[i] != 0 {
+				img.SetNRGBA(col, m.Height-1-row, coveredColor)
+			} else if inside[i] {
+				img.SetNRGBA(col, m.Height-1-row, uncoveredColor)
+			}
+		}
+	}
+
+	return img
+}
+
+// GeoJSON returns a FeatureCollection of covered strips, one rectangle per horizontal run of cells, in local meters
+func (m *CoverageMapStruct) GeoJSON() map[string]interface{} {
+	var polygons [][][][2]float64
+	for row := 0; row < m.Height; row++ {
+		start := -1
+		for col := 0; col <= m.Width; col++ {
+			covered := col < m.Width && m.Cells[row*m.Width+col] != 0
+			if covered && start < 0 {
+				start = col
+			} else if !covered && start >= 0 {
+				x1 := m.OriginX + float64(start)*m.CellSize
+				x2 := m.OriginX + float64(col)*m.CellSize
+				y1 := m.OriginY + float64(row)*m.CellSize
+				y2 := y1 + m.CellSize
+				polygons = append(polygons, [][][2]float64{{{x1, y1}, {x2, y1}, {x2, y2}, {x1, y2}, {x1, y1}}})
+				start = -1
+			}
+		}
+	}
+
+	boundary := make([][2]float64, 0, len(m.Zone.Boundary)+1)
+	for _, p := range m.Zone.Boundary {
+		boundary = append(boundary, [2]float64{p.X, p.Y})
+	}
+	if len(boundary) > 0 {
+		boundary = append(boundary, boundary[0])
+	}
+
+	return map[string]interface{}{
+		"type": "FeatureCollection",
+		"features": []interface{}{
+			map[string]interface{}{
+				"type":       "Feature",
+				"properties": map[string]interface{}{"zone": m.Zone.Name, "kind": "boundary"},
+				"geometry":   map[string]interface{}{"type": "Polygon", "coordinates": [][][2]float64{boundary}},
+			},
+			map[string]interface{}{
+				"type":       "Feature",
+				"properties": map[string]interface{}{"zone": m.Zone.Name, "kind": "covered", "percent_covered": math.Round(m.PercentCovered()*10) / 10},
+				"geometry":   map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons},
+			},
+		},
+	}
+}
+
+// Reset clears all recorded coverage
+func (m *CoverageMapStruct) Reset() {
+	m.Cells = make([]byte, m.Width*m.Height)
+	m.lastPose = nil
+	m.dirty = true
+	m.UpdatedAt = time.Now()
+}
+
+// Save persists the map if it has changed since it was last written
+func (m *CoverageMapStruct) Save() error {
+	if !m.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(coveragePath(m.Zone.Name), data)
+	if err != nil {
+		return err
+	}
+
+	m.dirty = false
+	m.savedAt = time.Now()
+	return nil
+}
+
+// CoverageMap returns the coverage map for a zone, loading it from disk if it is not already in memory
+func CoverageMap(zoneName string) (*CoverageMapStruct, error) {
+	if m, ok := MowerController.coverage[zoneName]; ok {
+		return m, nil
+	}
+
+	data, err := ioutil.ReadFile(coveragePath(zoneName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no coverage recorded for zone " + zoneName)
+		}
+		return nil, err
+	}
+
+	var m CoverageMapStruct
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Cells) != m.Width*m.Height {
+		return nil, errors.New("coverage map for zone " + zoneName + " is corrupt")
+	}
+
+	MowerController.coverage[zoneName] = &m
+	return &m, nil
+}
+
+// UpdateCoverage records the cutter footprint at the current pose into the active job's zone
+func UpdateCoverage() {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning {
+		return
+	}
+
+	m, err := CoverageMap(job.Zone.Name)
+	if err != nil {
+		m, err = NewCoverageMap(job.Zone, job.Plan)
+		if err != nil {
+			return
+		}
+		MowerController.coverage[job.Zone.Name] = m
+	}
+
+	if MowerState.Cutter.Speed <= 0 {
+		m.BreakTrajectory()
+		return
+	}
+
+	// only grass that had not been cut before counts, overlapping strips and repeat passes add nothing
+	job.Energy.AreaMowed += float64(m.Sweep(MowerState.Pose)) * m.CellSize * m.CellSize
+	job.Energy.updateRate()
+	MowerState.Job.PercentCovered = math.Round(m.PercentCovered()*10) / 10
+
+	if time.Since(m.savedAt) >= coverageSaveInterval {
+		if err := m.Save(); err != nil {
+			log.Errorf("unable to save coverage for zone %v: %v", job.Zone.Name, err)
+		}
+	}
+}
+
+// saveCoverage flushes the active zone's coverage map, and breaks the trajectory so a resumed job does not sweep across the gap
+func saveCoverage(zoneName string) {
+	m, ok := MowerController.coverage[zoneName]
+	if !ok {
+		return
+	}
+
+	m.BreakTrajectory()
+	if err := m.Save(); err != nil {
+		log.Errorf("unable to save coverage for zone %v: %v", zoneName, err)
+	}
+}
+
+func (m *CoverageMapStruct) cellAt(x, y float64) (col, row int) {
+	return int(math.Floor((x - m.OriginX) / m.CellSize)), int(math.Floor((y - m.OriginY) / m.CellSize))
+}
+
+func (m *CoverageMapStruct) cellCenter(col, row int) (x, y float64) {
+	return m.OriginX + (float64(col)+0.5)*m.CellSize, m.OriginY + (float64(row)+0.5)*m.CellSize
+}
+
+// coveredNear reports whether the cell or any cell within rows of it vertically has been mowed
+func (m *CoverageMapStruct) coveredNear(col, row, rows int) bool {
+	for r := maxInt(row-rows, 0); r <= minInt(row+rows, m.Height-1); r++ {
+		if m.Cells[r*m.Width+col] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// insideZone caches which cells have their center inside the zone boundary, every cell counts when there is no boundary
+func (m *CoverageMapStruct) insideZone() []bool {
+	if m.zoneCells != nil {
+		return m.zoneCells
+	}
+
+	m.zoneCells = make([]bool, m.Width*m.Height)
+	for row := 0; row < m.Height; row++ {
+		for col := 0; col < m.Width; col++ {
+			x, y := m.cellCenter(col, row)
+			m.zoneCells[row*m.Width+col] = len(m.Zone.Boundary) < 3 || pointInPolygon(x, y, m.Zone.Boundary)
+		}
+	}
+
+	return m.zoneCells
+}
+
+func coveragePath(zoneName string) string {
+	return filepath.Join(config.Current().Mower.DataDirectory, coverageDirectory, unsafeZoneName.ReplaceAllString(zoneName, "_")+".json")
+}
+
+func cutterWidth() float64 {
+	cfg := config.Current()
+
+	if cfg != nil && cfg.Mower.CutterWidth > 0 {
+		return cfg.Mower.CutterWidth
+	}
+
+	return defaultCutterWidth
+}
+
+// pointInPolygon is the standard even-odd ray casting test
+func pointInPolygon(x, y float64, polygon []Waypoint) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Y > y) != (b.Y > y) && x < (b.X-a.X)*(y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,242 @@
+package control
+
+import (
+	"errors"
+	"math"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	DockStatusIdle        = "idle"
+	DockStatusApproaching = "approaching"
+	DockStatusAligning    = "aligning"
+	DockStatusCreeping    = "creeping"
+	DockStatusDocked      = "docked"
+	DockStatusFailed      = "failed"
+
+	defaultDockApproachDistance = 1.0
+	defaultDockCreepVelocity    = 0.1
+	defaultDockChargingCurrent  = 0.1
+	defaultDockAlignTolerance   = 0.05
+
+	// how far past the dock we will creep looking for charge current before giving up
+	dockOvershoot = 0.3
+
+	// proportional gains used to steer onto the dock heading and back onto the dock centerline
+	dockHeadingGain = 2.0
+	dockLateralGain = 2.0
+)
+
+type dockingStruct struct {
+	status     string
+	creepStart Pose
+}
+
+// DockFailureEvent is the detail of a failed docking event
+type DockFailureEvent struct {
+	Reason string `json:"reason"`
+	// what sent the mower home, such as low_battery
+	DockReason string `json:"dock_reason"`
+	// the job that was waiting to resume after charging, it stays paused
+	JobID string `json:"job_id,omitempty"`
+}
+
+// DockPose returns the configured pose the mower sits at when it is on the charger
+func DockPose() Pose {
+	dock := config.Current().Dock
+	return Pose{X: dock.X, Y: dock.Y, Heading: dock.Heading}
+}
+
+// DockApproachPose is the point in line with the dock, one approach distance out, that we drive to before creeping in
+func DockApproachPose() Pose {
+	dock := DockPose()
+	d := dockApproachDistance()
+
+	return Pose{
+		X:       dock.X - d*math.Cos(dock.Heading),
+		Y:       dock.Y - d*math.Sin(dock.Heading),
+		Heading: dock.Heading,
+	}
+}
+
+// ReturnHome pauses any running job and starts driving back to the dock
+func ReturnHome() error {
+	if MowerState.Dock.Status == DockStatusDocked && IsCharging() {
+		return errors.New("already docked")
+	}
+	if !ProtectionAllowsDrive() {
+		return errors.New("protection level " + MowerState.Protection.Level + " is active")
+	}
+
+	if job := MowerController.job; job != nil && job.Status == JobStatusRunning {
+		PauseJob()
+	}
+
+	MowerState.Cutter.Speed = 0
+	StopDrive()
+	MowerState.Mode = ModeAutonomous
+
+	// there is no map to plan around yet, so the plan is a straight line to the approach point
+	approach := DockApproachPose()
+	FollowPath([]Waypoint{{X: approach.X, Y: approach.Y}})
+
+	setDockStatus(DockStatusApproaching)
+	MowerState.Dock.Reason = DockReasonManual
+	return nil
+}
+
+// CancelReturnHome stops the docking behavior wherever it is
+func CancelReturnHome() {
+	if MowerController.docking == nil {
+		return
+	}
+
+	StopPath()
+	MowerState.Mode = ModeManual
+
+	MowerController.docking = nil
+	MowerState.Dock.Status = DockStatusIdle
+	MowerState.Dock.Reason = ""
+}
+
+// IsCharging reports whether the INA219 sees current flowing back into the battery
+func IsCharging() bool {
+	cfg := config.Current()
+
+	threshold := defaultDockChargingCurrent
+	if cfg.Dock.ChargingCurrent > 0 {
+		threshold = cfg.Dock.ChargingCurrent
+	}
+
+	return MowerState.Battery.Current <= -threshold
+}
+
+// UpdateDocking steps the docking behavior, called from the navigation loop after the path follower has run
+func UpdateDocking() {
+	MowerState.Dock.Charging = IsCharging()
+
+	docking := MowerController.docking
+	if docking == nil {
+		return
+	}
+
+	dock := DockPose()
+	pose := MowerState.Pose
+
+	switch docking.status {
+	case DockStatusApproaching:
+		if MowerController.pathFollower == nil && MowerState.Navigation.Status == "arrived" {
+			setDockStatus(DockStatusAligning)
+		} else if MowerController.pathFollower == nil {
+			// the approach path was stopped out from under us
+			failDocking("approach interrupted")
+		}
+
+	case DockStatusAligning:
+		headingError := normalizeAngle(dock.Heading - pose.Heading)
+		if math.Abs(headingError) <= dockAlignTolerance() {
+			docking.creepStart = pose
+			setDockStatus(DockStatusCreeping)
+			return
+		}
+
+		MowerState.Navigation.Command = VelocityCommand{Linear: 0, Angular: clampAngular(dockHeadingGain * headingError)}
+
+	case DockStatusCreeping:
+		if IsCharging() {
+			MowerState.Navigation.Command = VelocityCommand{}
+			MowerState.Mode = ModeManual
+			setDockStatus(DockStatusDocked)
+
+			MowerController.docking = nil
+			return
+		}
+
+		if distance(docking.creepStart.X, docking.creepStart.Y, pose.X, pose.Y) > dockApproachDistance()+dockOvershoot {
+			failDocking("no charging current detected")
+			return
+		}
+
+		// steer back onto the line through the approach point and the dock as we creep in
+		approach := DockApproachPose()
+		crossTrack := signedCrossTrack(pose, Waypoint{X: approach.X, Y: approach.Y}, Waypoint{X: dock.X, Y: dock.Y})
+		MowerState.Navigation.CrossTrackError = math.Round(crossTrack*1000) / 1000
+
+		headingError := normalizeAngle(dock.Heading - math.Atan(dockLateralGain*crossTrack) - pose.Heading)
+		MowerState.Navigation.Command = VelocityCommand{Linear: dockCreepVelocity(), Angular: clampAngular(dockHeadingGain * headingError)}
+	}
+}
+
+func setDockStatus(status string) {
+	if MowerController.docking == nil {
+		MowerController.docking = &dockingStruct{}
+	}
+
+	MowerController.docking.status = status
+	MowerState.Dock.Status = status
+
+	log.Infof("dock: %v", status)
+}
+
+func failDocking(reason string) {
+	log.Warnf("dock: failed, %v", reason)
+
+	StopPath()
+	MowerState.Mode = ModeManual
+
+	event := DockFailureEvent{Reason: reason, DockReason: MowerState.Dock.Reason, JobID: MowerController.lowBatteryJobID}
+	RecordEvent(EventSeverityWarning, EventTypeDock, "dock "+MowerState.Dock.Status+" -> "+DockStatusFailed+": "+reason, event)
+
+	// a failed trip home must not resume the job on its own if the mower is later put on the dock
+	MowerController.lowBatteryJobID = ""
+	MowerController.docking = nil
+	MowerState.Dock.Status = DockStatusFailed
+	MowerState.Dock.Reason = ""
+
+	// the event above already covers this transition
+	MowerController.lastDockStatus = DockStatusFailed
+}
+
+func dockApproachDistance() float64 {
+	cfg := config.Current()
+
+	if cfg.Dock.ApproachDistance > 0 {
+		return cfg.Dock.ApproachDistance
+	}
+	return defaultDockApproachDistance
+}
+
+func dockCreepVelocity() float64 {
+	cfg := config.Current()
+
+	if cfg.Dock.CreepVelocity > 0 {
+		return cfg.Dock.CreepVelocity
+	}
+	return defaultDockCreepVelocity
+}
+
+func dockAlignTolerance() float64 {
+	cfg := config.Current()
+
+	if cfg.Dock.AlignTolerance > 0 {
+		return cfg.Dock.AlignTolerance
+	}
+	return defaultDockAlignTolerance
+}
+
+func clampAngular(angular float64) float64 {
+	cfg := config.Current()
+
+	limit := defaultMaxAngularVelocity
+	if cfg.Navigation.MaxAngularVelocity > 0 {
+		limit = cfg.Navigation.MaxAngularVelocity
+	}
+
+	return math.Max(-limit, math.Min(angular, limit))
+}
+
+// normalizeAngle wraps an angle in radians into -Pi..Pi
+func normalizeAngle(angle float64) float64 {
+	return math.Atan2(math.Sin(angle), math.Cos(angle))
+}
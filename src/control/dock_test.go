@@ -0,0 +1,58 @@
+package control
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailDockingForgetsLowBatteryJob(t *testing.T) {
+	startTestController(t)
+
+	var status, reason, jobID string
+	var err error
+	Do(func() {
+		if err = ReturnHome(); err != nil {
+			return
+		}
+		MowerState.Dock.Reason = DockReasonLowBattery
+		MowerController.lowBatteryJobID = "interrupted"
+
+		// losing the approach path fails the docking
+		StopPath()
+		UpdateDocking()
+		checkTransitions()
+
+		status, reason, jobID = MowerState.Dock.Status, MowerState.Dock.Reason, MowerController.lowBatteryJobID
+		MowerState.Dock.Status = DockStatusIdle
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != DockStatusFailed || reason != "" || jobID != "" {
+		t.Fatalf("dock %q with reason %q and job %q to resume, want failed with neither", status, reason, jobID)
+	}
+
+	flushEvents()
+	events, err := Events(EventQuery{Types: []string{EventTypeDock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failures []EventStruct
+	for _, event := range events {
+		if strings.HasSuffix(event.Message, "-> "+DockStatusFailed+": approach interrupted") {
+			failures = append(failures, event)
+		} else if strings.HasSuffix(event.Message, "-> "+DockStatusFailed) {
+			t.Errorf("failure recorded twice, also as %q", event.Message)
+		}
+	}
+	if len(failures) != 1 {
+		t.Fatalf("%v failure events, want 1", len(failures))
+	}
+
+	details, _ := failures[0].Details.(map[string]interface{})
+	if details["dock_reason"] != DockReasonLowBattery || details["job_id"] != "interrupted" {
+		t.Errorf("failure details %v, want the low battery trip and its job", failures[0].Details)
+	}
+}
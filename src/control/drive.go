@@ -0,0 +1,188 @@
+package control
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	DriveDirectionStopped  = "stopped"
+	DriveDirectionVelocity = "velocity"
+
+	// change in normalized velocity allowed per second
+	defaultDriveLinearAcceleration  = 1.0
+	defaultDriveAngularAcceleration = 2.0
+
+	// a joystick has to keep sending, the mower stops if it goes quiet for this long
+	defaultDriveCommandTimeout = 500 * time.Millisecond
+)
+
+// driveStruct holds the joystick velocity, target is what was asked for and output is what the wheels are being given
+type driveStruct struct {
+	target      VelocityCommand
+	output      VelocityCommand
+	commandedAt time.Time
+	updatedAt   time.Time
+}
+
+// SetVelocity sets the manual drive velocity, linear and angular are normalized to -1..1 with positive angular turning left
+func SetVelocity(linear float64, angular float64) error {
+	if linear < -1 || linear > 1 || angular < -1 || angular > 1 {
+		return errors.New("linear and angular must be between -1 and 1")
+	}
+	if !ProtectionAllowsDrive() {
+		return errors.New("drive is held off by protection level " + MowerState.Protection.Level)
+	}
+
+	// driving takes over from a running job or docking, an idle or released stick does not
+	if MowerState.Mode == ModeAutonomous && (linear != 0 || angular != 0) {
+		CancelReturnHome()
+		PauseJob()
+	}
+
+	drive := MowerController.drive
+	drive.target = VelocityCommand{Linear: linear, Angular: angular}
+	drive.commandedAt = time.Now()
+
+	if linear == 0 && angular == 0 {
+		MowerState.Drive.Direction = DriveDirectionStopped
+	} else {
+		MowerState.Drive.Direction = DriveDirectionVelocity
+	}
+
+	return nil
+}
+
+// StopDrive zeroes the joystick velocity and the wheel outputs at once, stopping is never rate limited
+func StopDrive() {
+	drive := MowerController.drive
+	drive.target = VelocityCommand{}
+	drive.output = VelocityCommand{}
+
+	MowerState.Drive.Direction = DriveDirectionStopped
+	MowerState.Drive.Command = VelocityCommand{}
+	MowerState.Drive.Left = 0
+	MowerState.Drive.Right = 0
+}
+
+// EmergencyStop stops the blade and the wheels and drops out of any job or docking, exactly as a stop level protection trip does
+func EmergencyStop(caller ControllerIdentity) {
+	log.Warnf("emergency stop by %v", describeIdentity(caller))
+	RecordEvent(EventSeverityCritical, EventTypeEmergencyStop, "emergency stop by "+describeIdentity(caller), caller)
+
+	applyProtection(ProtectionLevelStop)
+}
+
+// UpdateDrive applies the watchdog and rate limits to the joystick or navigation velocity and mixes it onto the wheels, called from the navigation loop after the path follower and docking have run
+func UpdateDrive() {
+	drive := MowerController.drive
+	now := time.Now()
+
+	dt := now.Sub(drive.updatedAt).Seconds()
+	if drive.updatedAt.IsZero() || dt > 1 {
+		dt = navigationInterval.Seconds()
+	}
+	drive.updatedAt = now
+
+	// a joystick that went quiet is treated as lost, the wheels stop at once rather than coasting down
+	if drive.target != (VelocityCommand{}) && now.Sub(drive.commandedAt) > driveCommandTimeout() {
+		drive.target = VelocityCommand{}
+		drive.output = VelocityCommand{}
+		MowerState.Drive.Direction = DriveDirectionStopped
+	}
+
+	// a job or docking steers with the navigation command, a joystick that moves pauses them first
+	target := drive.target
+	if MowerState.Mode == ModeAutonomous && (MowerController.pathFollower != nil || MowerController.docking != nil) {
+		target = navigationTarget()
+	}
+
+	linearRate, angularRate := driveAcceleration()
+	drive.output.Linear = rateLimit(drive.output.Linear, target.Linear, linearRate*dt)
+	drive.output.Angular = rateLimit(drive.output.Angular, target.Angular, angularRate*dt)
+
+	scale := float64(MowerState.Drive.Speed) / 100
+	left, right := mixDifferential(drive.output.Linear, drive.output.Angular)
+
+	// TODO actual callout logic to the wheel drivers, right now we'll just update state
+	MowerState.Drive.Command = VelocityCommand{
+		Linear:  math.Round(drive.output.Linear*1000) / 1000,
+		Angular: math.Round(drive.output.Angular*1000) / 1000,
+	}
+	MowerState.Drive.Left = math.Round(left*scale*1000) / 1000
+	MowerState.Drive.Right = math.Round(right*scale*1000) / 1000
+}
+
+// navigationTarget normalizes the navigation command, in m/s and rad/s, against the navigation velocity limits
+func navigationTarget() VelocityCommand {
+	cfg := config.Current()
+
+	maxLinear := defaultMaxLinearVelocity
+	if cfg.Navigation.MaxLinearVelocity > 0 {
+		maxLinear = cfg.Navigation.MaxLinearVelocity
+	}
+	maxAngular := defaultMaxAngularVelocity
+	if cfg.Navigation.MaxAngularVelocity > 0 {
+		maxAngular = cfg.Navigation.MaxAngularVelocity
+	}
+
+	command := MowerState.Navigation.Command
+	return VelocityCommand{
+		Linear:  math.Max(-1, math.Min(command.Linear/maxLinear, 1)),
+		Angular: math.Max(-1, math.Min(command.Angular/maxAngular, 1)),
+	}
+}
+
+// mixDifferential turns a normalized linear and angular velocity into left and right wheel outputs, scaled back so neither wheel exceeds 1
+func mixDifferential(linear float64, angular float64) (left float64, right float64) {
+	left = linear - angular
+	right = linear + angular
+
+	peak := math.Max(math.Abs(left), math.Abs(right))
+	if peak > 1 {
+		left /= peak
+		right /= peak
+	}
+
+	return left, right
+}
+
+func rateLimit(current float64, target float64, step float64) float64 {
+	if target > current+step {
+		return current + step
+	}
+	if target < current-step {
+		return current - step
+	}
+
+	return target
+}
+
+func driveAcceleration() (linear float64, angular float64) {
+	cfg := config.Current()
+
+	linear = defaultDriveLinearAcceleration
+	if cfg.Drive.LinearAcceleration > 0 {
+		linear = cfg.Drive.LinearAcceleration
+	}
+
+	angular = defaultDriveAngularAcceleration
+	if cfg.Drive.AngularAcceleration > 0 {
+		angular = cfg.Drive.AngularAcceleration
+	}
+
+	return linear, angular
+}
+
+func driveCommandTimeout() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Drive.CommandTimeout > 0 {
+		return time.Duration(cfg.Drive.CommandTimeout) * time.Millisecond
+	}
+
+	return defaultDriveCommandTimeout
+}
@@ -0,0 +1,58 @@
+package control
+
+import (
+	"testing"
+)
+
+func TestJobDrivesWheels(t *testing.T) {
+	startTestController(t)
+
+	var left, right float64
+	var err error
+	Do(func() {
+		MowerState.Pose = Pose{}
+		err = StartJob(JobRequest{
+			Zone: Zone{Name: "drive", Boundary: []Waypoint{{X: -1, Y: -1}, {X: 5, Y: -1}, {X: 5, Y: 5}, {X: -1, Y: 5}}},
+			Plan: []Waypoint{{X: 2, Y: 0}, {X: 2, Y: 2}},
+		})
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < 5; i++ {
+			UpdateNavigation()
+			UpdateDocking()
+			UpdateDrive()
+		}
+		left, right = MowerState.Drive.Left, MowerState.Drive.Right
+
+		AbortJob()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if left <= 0 || right <= 0 {
+		t.Fatalf("wheels are at %v, %v with a job driving straight ahead, want both forward", left, right)
+	}
+}
+
+func TestJoystickWithoutJob(t *testing.T) {
+	startTestController(t)
+
+	var left, right float64
+	Do(func() {
+		StopDrive()
+		if err := SetVelocity(0, 1); err != nil {
+			t.Error(err)
+		}
+		UpdateDrive()
+		left, right = MowerState.Drive.Left, MowerState.Drive.Right
+
+		StopDrive()
+	})
+
+	if left >= 0 || right <= 0 {
+		t.Fatalf("wheels are at %v, %v turning left on the joystick, want left back and right forward", left, right)
+	}
+}
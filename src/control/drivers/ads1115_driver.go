@@ -0,0 +1,121 @@
+package drivers
+
+import (
+	"errors"
+	"time"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/drivers/i2c"
+)
+
+const (
+	ADS1115_ADDRESS = 0x48
+
+	ADS1115_REG_CONVERSION = 0x00
+	ADS1115_REG_CONFIG     = 0x01
+
+	// start a single conversion
+	ADS1115_CONFIG_OS_SINGLE = 0x8000
+	// AIN0..AIN3 against ground are mux settings 4..7
+	ADS1115_CONFIG_MUX_SINGLE_0 = 0x4000
+	ADS1115_CONFIG_MUX_SHIFT    = 12
+	// +-4.096V full scale
+	ADS1115_CONFIG_PGA_4_096V  = 0x0200
+	ADS1115_CONFIG_MODE_SINGLE = 0x0100
+	// 128 samples per second, a conversion takes just under 8ms
+	ADS1115_CONFIG_DR_128SPS    = 0x0080
+	ADS1115_CONFIG_COMP_DISABLE = 0x0003
+
+	ADS1115_FULL_SCALE      = 4.096
+	ADS1115_CONVERSION_TIME = 10 * time.Millisecond
+)
+
+// ADS1115Driver reads single ended voltages from the four inputs of an ADS1115 ADC, one conversion at a time.
+type ADS1115Driver struct {
+	name       string
+	connector  i2c.Connector
+	connection i2c.Connection
+	i2c.Config
+}
+
+// NewADS1115Driver creates a new driver with the specified i2c interface.
+// Params:
+//
+//	conn Connector - the Adaptor to use with this Driver
+//
+// Optional params:
+//
+//	i2c.WithBus(int):		bus to use with this driver
+//	i2c.WithAddress(int):		address to use with this driver
+func NewADS1115Driver(c i2c.Connector, options ...func(i2c.Config)) *ADS1115Driver {
+	a := &ADS1115Driver{
+		name:      gobot.DefaultName("ADS1115"),
+		connector: c,
+		Config:    i2c.NewConfig(),
+	}
+
+	for _, option := range options {
+		option(a)
+	}
+
+	return a
+}
+
+// Name returns the name of the device.
+func (a *ADS1115Driver) Name() string {
+	return a.name
+}
+
+// SetName sets the name of the device.
+func (a *ADS1115Driver) SetName(name string) {
+	a.name = name
+}
+
+// Connection returns the connection of the device.
+func (a *ADS1115Driver) Connection() gobot.Connection {
+	return a.connector.(gobot.Connection)
+}
+
+// Start opens the connection to the ADS1115, nothing is configured until a reading is asked for
+func (a *ADS1115Driver) Start() (err error) {
+	bus := a.GetBusOrDefault(a.connector.GetDefaultBus())
+	address := a.GetAddressOrDefault(ADS1115_ADDRESS)
+
+	a.connection, err = a.connector.GetConnection(address, bus)
+	return err
+}
+
+// Halt halts the device.
+func (a *ADS1115Driver) Halt() error {
+	return nil
+}
+
+// ReadVoltage converts the voltage on input channel 0-3 against ground, in V
+func (a *ADS1115Driver) ReadVoltage(channel int) (float64, error) {
+	if channel < 0 || channel > 3 {
+		return 0, errors.New("ADS1115Driver Error: channel must be 0 to 3")
+	}
+
+	config := ADS1115_CONFIG_OS_SINGLE |
+		ADS1115_CONFIG_MUX_SINGLE_0 | channel<<ADS1115_CONFIG_MUX_SHIFT |
+		ADS1115_CONFIG_PGA_4_096V |
+		ADS1115_CONFIG_MODE_SINGLE |
+		ADS1115_CONFIG_DR_128SPS |
+		ADS1115_CONFIG_COMP_DISABLE
+
+	if err := a.connection.WriteBlockData(ADS1115_REG_CONFIG, []byte{byte(config >> 8), byte(config & 0x00FF)}); err != nil {
+		return 0, err
+	}
+
+	time.Sleep(ADS1115_CONVERSION_TIME)
+
+	val, err := a.connection.ReadWordData(ADS1115_REG_CONVERSION)
+	if err != nil {
+		return 0, err
+	}
+
+	// the ADS1115 sends the high byte first
+	raw := int16(((val & 0x00FF) << 8) | ((val & 0xFF00) >> 8))
+
+	return float64(raw) * ADS1115_FULL_SCALE / 32768, nil
+}
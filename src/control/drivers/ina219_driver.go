@@ -7,6 +7,8 @@ package drivers
 //
 
 import (
+	"math"
+
 	"gobot.io/x/gobot"
 	"gobot.io/x/gobot/drivers/i2c"
 )
@@ -52,6 +54,10 @@ const (
 	INA219_CONFIG_MODE_SANDBVOLT_CONTINUOUS = 0x0007
 
 	INA219_SHUNTRESISTOR_VALUE float64 = 0.1
+	INA219_MAXCURRENT_VALUE    float64 = 3.2
+
+	// the calibration register holds 15 bits, bit 0 is always zero
+	INA219_CALIBRATION_MAX = 0xFFFE
 
 	INA219_REG_CONFIG       = 0x00
 	INA219_REG_SHUNTVOLTAGE = 0x01
@@ -69,6 +75,14 @@ type INA219Driver struct {
 	i2c.Config
 	CalibrationValue uint16
 	halt             chan bool
+
+	shuntResistance float64
+	maxCurrent      float64
+	gain            int
+	averaging       int
+
+	currentLSB float64
+	powerLSB   float64
 }
 
 // NewINA219Driver creates a new driver with the specified i2c interface.
@@ -78,21 +92,119 @@ type INA219Driver struct {
 // Optional params:
 //		i2c.WithBus(int):		bus to use with this driver
 //		i2c.WithAddress(int):		address to use with this driver
+//		WithINA219ShuntResistance(float64):	shunt resistor value in ohms
+//		WithINA219MaxCurrent(float64):		largest current expected in amps, sets the current resolution
+//		WithINA219Gain(int):		one of the INA219_CONFIG_GAIN values, chosen from the max current when not set
+//		WithINA219Averaging(int):	number of ADC samples averaged per reading, 1 to 128
 func NewINA219Driver(c i2c.Connector, options ...func(i2c.Config)) *INA219Driver {
 	i := &INA219Driver{
-		name:             gobot.DefaultName("INA219"),
-		connector:        c,
-		Config:           i2c.NewConfig(),
-		CalibrationValue: 4027,
+		name:            gobot.DefaultName("INA219"),
+		connector:       c,
+		Config:          i2c.NewConfig(),
+		shuntResistance: INA219_SHUNTRESISTOR_VALUE,
+		maxCurrent:      INA219_MAXCURRENT_VALUE,
+		gain:            -1,
+		averaging:       1,
 	}
 
 	for _, option := range options {
 		option(i)
 	}
 
+	i.calibrate()
+
 	return i
 }
 
+// WithINA219ShuntResistance sets the shunt resistor value in ohms
+func WithINA219ShuntResistance(ohms float64) func(i2c.Config) {
+	return func(c i2c.Config) {
+		if d, ok := c.(*INA219Driver); ok && ohms > 0 {
+			d.shuntResistance = ohms
+		}
+	}
+}
+
+// WithINA219MaxCurrent sets the largest current in amps the INA219 is expected to measure
+func WithINA219MaxCurrent(amps float64) func(i2c.Config) {
+	return func(c i2c.Config) {
+		if d, ok := c.(*INA219Driver); ok && amps > 0 {
+			d.maxCurrent = amps
+		}
+	}
+}
+
+// WithINA219Gain sets the shunt voltage range, one of the INA219_CONFIG_GAIN values
+func WithINA219Gain(gain int) func(i2c.Config) {
+	return func(c i2c.Config) {
+		if d, ok := c.(*INA219Driver); ok {
+			d.gain = gain & INA219_CONFIG_GAIN_MASK
+		}
+	}
+}
+
+// WithINA219Averaging sets how many ADC samples are averaged per reading, rounded up to a power of two up to 128
+func WithINA219Averaging(samples int) func(i2c.Config) {
+	return func(c i2c.Config) {
+		if d, ok := c.(*INA219Driver); ok && samples > 0 {
+			d.averaging = samples
+		}
+	}
+}
+
+// ShuntResistance returns the configured shunt resistor value in ohms
+func (i *INA219Driver) ShuntResistance() float64 {
+	return i.shuntResistance
+}
+
+// CurrentLSB returns the resolution of the current register in amps
+func (i *INA219Driver) CurrentLSB() float64 {
+	return i.currentLSB
+}
+
+// calibrate derives the calibration register from the shunt resistance and max expected current, per the INA219 datasheet
+func (i *INA219Driver) calibrate() {
+	i.currentLSB = i.maxCurrent / 32768
+
+	calibration := math.Trunc(0.04096 / (i.currentLSB * i.shuntResistance))
+	if calibration > INA219_CALIBRATION_MAX {
+		// shunt too small for the requested resolution, settle for the finest resolution the register allows
+		calibration = INA219_CALIBRATION_MAX
+		i.currentLSB = 0.04096 / (calibration * i.shuntResistance)
+	}
+
+	i.CalibrationValue = uint16(calibration) &^ 1
+	i.powerLSB = 20 * i.currentLSB
+
+	if i.gain < 0 {
+		i.gain = gainForShuntVoltage(i.maxCurrent * i.shuntResistance)
+	}
+}
+
+// gainForShuntVoltage picks the smallest shunt voltage range that covers the expected maximum
+func gainForShuntVoltage(volts float64) int {
+	switch {
+	case volts <= 0.04:
+		return INA219_CONFIG_GAIN_1_40MV
+	case volts <= 0.08:
+		return INA219_CONFIG_GAIN_2_80MV
+	case volts <= 0.16:
+		return INA219_CONFIG_GAIN_4_160MV
+	default:
+		return INA219_CONFIG_GAIN_8_320MV
+	}
+}
+
+// adcMode returns the 4 bit ADC resolution/averaging mode for a sample count
+func adcMode(samples int) int {
+	mode := 0x8 // 12 bit, single sample
+	for n := 2; n <= 128 && samples > n/2; n *= 2 {
+		mode++
+	}
+
+	return mode
+}
+
 // Name returns the name of the device.
 func (i *INA219Driver) Name() string {
 	return i.name
@@ -122,9 +234,7 @@ func (i *INA219Driver) Start() error {
 		return err
 	}
 
-	i.connection.WriteBlockData(INA219_REG_CALIBRATION, []byte{byte(i.CalibrationValue >> 8), byte(i.CalibrationValue & 0x00FF)})
-
-	return nil
+	return i.connection.WriteBlockData(INA219_REG_CALIBRATION, []byte{byte(i.CalibrationValue >> 8), byte(i.CalibrationValue & 0x00FF)})
 }
 
 // Halt halts the device.
@@ -142,7 +252,7 @@ func (i *INA219Driver) GetBusVoltage() (float64, error) {
 	return float64((value>>3)*4) * 0.001, nil
 }
 
-// GetShuntVoltage Gets the shunt voltage in mV
+// GetShuntVoltage Gets the shunt voltage in V
 func (i *INA219Driver) GetShuntVoltage() (float64, error) {
 	value, err := i.getShuntVoltageRaw()
 	if err != nil {
@@ -152,18 +262,27 @@ func (i *INA219Driver) GetShuntVoltage() (float64, error) {
 	return float64(value) * 0.00001, nil
 }
 
-// GetCurrent gets the current value in mA, taking into account the config settings and current LSB
+// GetCurrent gets the current value in A, taking into account the config settings and current LSB
 func (i *INA219Driver) GetCurrent() (float64, error) {
-	value, err := i.GetShuntVoltage()
+	value, err := i.getCurrentRaw()
 	if err != nil {
 		return 0, err
 	}
 
-	ma := value / INA219_SHUNTRESISTOR_VALUE
-	return ma, nil
+	return float64(value) * i.currentLSB, nil
 }
 
-// GetLoadVoltage gets the load voltage in mV
+// GetPower gets the power value in W, taking into account the config settings and power LSB
+func (i *INA219Driver) GetPower() (float64, error) {
+	value, err := i.readWordFromRegister(INA219_REG_POWER)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(value) * i.powerLSB, nil
+}
+
+// GetLoadVoltage gets the load voltage in V
 func (i *INA219Driver) GetLoadVoltage() (float64, error) {
 	bv, err := i.GetBusVoltage()
 	if err != nil {
@@ -175,7 +294,7 @@ func (i *INA219Driver) GetLoadVoltage() (float64, error) {
 		return 0, err
 	}
 
-	return bv + (sv / 1000.0), nil
+	return bv + sv, nil
 }
 
 // getBusVoltageRaw gets the raw bus voltage (16-bit signed integer, so +-32767)
@@ -245,10 +364,12 @@ func (i *INA219Driver) readWordFromRegister(reg uint8) (uint16, error) {
 
 // initialize initializes the INA219 device
 func (i *INA219Driver) initialize() error {
+	mode := adcMode(i.averaging)
+
 	config := INA219_CONFIG_BVOLTAGERANGE_32V |
-		INA219_CONFIG_GAIN_8_320MV |
-		INA219_CONFIG_BADCRES_12BIT |
-		INA219_CONFIG_SADCRES_12BIT_1S_532US |
+		i.gain |
+		(mode<<7)&INA219_CONFIG_BADCRES_MASK |
+		(mode<<3)&INA219_CONFIG_SADCRES_MASK |
 		INA219_CONFIG_MODE_SANDBVOLT_CONTINUOUS
 
 	return i.connection.WriteBlockData(INA219_REG_CONFIG, []byte{byte(config >> 8), byte(config & 0x00FF)})
@@ -9,14 +9,21 @@ package drivers
 import (
 	"errors"
 	//"fmt"
-	"log"
 	"math"
 	"time"
 
+	"github.com/dchote/robot-mower/src/logger"
+
 	"gobot.io/x/gobot"
 	"gobot.io/x/gobot/drivers/i2c"
 )
 
+var (
+	log = logger.New("drivers")
+	// the magnetometer is read with every IMU sample
+	magLog = log.Sampled(time.Second)
+)
+
 const (
 	MPU_ADDRESS               = 0x68
 	MPUREG_XG_OFFS_TC         = 0x00
@@ -364,7 +371,7 @@ func (mpu *MPU9250Driver) initialize() (err error) {
 	if err != nil {
 		return errors.New("MPU9250Driver unable to fetch device identity")
 	}
-	log.Printf("MPU9250Driver mpuIdentity: %v should be %v", mpuIdentity, 0x71)
+	log.Infof("MPU9250Driver mpuIdentity: %v should be %v", mpuIdentity, 0x71)
 
 	// gyro config
 	mpu.gResolution = 250.0 / float64(math.MaxInt16)
@@ -425,7 +432,7 @@ func (mpu *MPU9250Driver) initialize() (err error) {
 	mpu.a02 = float64(a0y << 2)
 	mpu.a03 = float64(a0z << 2)
 
-	log.Printf("MPU9250Driver accel hardware bias read: %v, %v, %v", mpu.a01, mpu.a02, mpu.a03)
+	log.Infof("MPU9250Driver accel hardware bias read: %v, %v, %v", mpu.a01, mpu.a02, mpu.a03)
 
 	g0x, _ := mpu.i2cRead16(MPUREG_XG_OFFS_USRH)
 	g0y, _ := mpu.i2cRead16(MPUREG_YG_OFFS_USRH)
@@ -435,7 +442,7 @@ func (mpu *MPU9250Driver) initialize() (err error) {
 	mpu.g02 = float64(g0y << 2)
 	mpu.g03 = float64(g0z << 2)
 
-	log.Printf("MPU9250Driver gyro hardware bias read: %v, %v, %v", mpu.g01, mpu.g02, mpu.g03)
+	log.Infof("MPU9250Driver gyro hardware bias read: %v, %v, %v", mpu.g01, mpu.g02, mpu.g03)
 
 	time.Sleep(50 * time.Millisecond)
 
@@ -450,7 +457,7 @@ func (mpu *MPU9250Driver) initialize() (err error) {
 		return errors.New("MPU9250Driver unable to fetch mag identity")
 	}
 
-	log.Printf("MPU9250Driver magIdentity: %v should be %v", magIdentity, AK8963_Device_ID)
+	log.Infof("MPU9250Driver magIdentity: %v should be %v", magIdentity, AK8963_Device_ID)
 
 	if magIdentity != AK8963_Device_ID {
 		return errors.New("MPU9250Driver invalid mag identity")
@@ -485,7 +492,7 @@ func (mpu *MPU9250Driver) initialize() (err error) {
 	mpu.magYcoef = (float64(int16(magBuf[1]))-128)/256.0 + 1.0
 	mpu.magZcoef = (float64(int16(magBuf[2]))-128)/256.0 + 1.0
 
-	log.Printf("MPU9250Driver mag hardware bias: %v, %v, %v coef: %v, %v, %v", magBuf[0], magBuf[1], magBuf[2], mpu.magXcoef, mpu.magYcoef, mpu.magZcoef)
+	log.Infof("MPU9250Driver mag hardware bias: %v, %v, %v coef: %v, %v, %v", magBuf[0], magBuf[1], magBuf[2], mpu.magXcoef, mpu.magYcoef, mpu.magZcoef)
 
 	// AK8963 power down & cleanup
 	mpu.connection.WriteByteData(MPUREG_I2C_SLV0_DO, 0x00)
@@ -561,12 +568,12 @@ func (mpu *MPU9250Driver) GetData() (err error) {
 	m3 = mpu.bufConvert(magBuf[4], magBuf[5])
 	m4 = int16(magBuf[6])
 
-	log.Printf("mag: %v, %v, %v", m1, m2, m3)
+	magLog.Debugf("mag: %v, %v, %v", m1, m2, m3)
 	// validate mag data
 	if (byte(m1&0xFF)&AKM_DATA_READY) == 0x00 && (byte(m1&0xFF)&AKM_DATA_OVERRUN) != 0x00 {
-		log.Println("MPU9250Driver Warning: mag data not ready or overflow")
+		magLog.Warnf("MPU9250Driver: mag data not ready or overflow")
 	} else if (byte((m4>>8)&0xFF) & AKM_OVERFLOW) != 0x00 {
-		log.Println("MPU9250Driver Warning: mag data overflow")
+		magLog.Warnf("MPU9250Driver: mag data overflow")
 	} else {
 		mpu.Data.M1 = (float64(m1) * mpu.magXcoef) * mpu.mResolution
 		mpu.Data.M2 = (float64(m2) * mpu.magYcoef) * mpu.mResolution
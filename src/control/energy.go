@@ -0,0 +1,307 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	EnergySplitMeasured = "measured"
+	EnergySplitDerived  = "derived"
+	EnergySplitNone     = "none"
+
+	jobHistoryFile = "job_history.json"
+
+	// only keep this many finished jobs on disk
+	maxJobHistory = 500
+
+	// a gap between power samples longer than this is a pause or a stall and is not integrated across
+	maxEnergySampleGap = 5 * time.Second
+)
+
+// JobConditions describe how a job was mowed so energy use can be compared between them
+type JobConditions struct {
+	Pattern        string  `json:"pattern,omitempty"`
+	BladeHeight    float64 `json:"blade_height,omitempty"`
+	GrassCondition string  `json:"grass_condition,omitempty"`
+}
+
+type JobEnergyStruct struct {
+	TotalWh  float64 `json:"total_wh"`
+	DriveWh  float64 `json:"drive_wh"`
+	CutterWh float64 `json:"cutter_wh"`
+	// how the drive/cutter split was obtained, derived means drive is the total less the cutter
+	Split string `json:"split"`
+
+	// distance driven with the cutter running in meters, and the area of the zone's coverage map it newly covered in square meters
+	Distance         float64 `json:"distance"`
+	AreaMowed        float64 `json:"area_mowed"`
+	WhPerSquareMeter float64 `json:"wh_per_square_meter"`
+
+	lastSample time.Time
+	lastPose   *Pose
+}
+
+type JobRecordStruct struct {
+	ID              string    `json:"id"`
+	Zone            string    `json:"zone"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"started_at"`
+	EndedAt         time.Time `json:"ended_at"`
+	PercentComplete float64   `json:"percent_complete"`
+	JobConditions
+	Energy JobEnergyStruct `json:"energy"`
+}
+
+type JobEnergyGroupStruct struct {
+	Key              string  `json:"key"`
+	Jobs             int     `json:"jobs"`
+	AreaMowed        float64 `json:"area_mowed"`
+	TotalWh          float64 `json:"total_wh"`
+	DriveWh          float64 `json:"drive_wh"`
+	CutterWh         float64 `json:"cutter_wh"`
+	WhPerSquareMeter float64 `json:"wh_per_square_meter"`
+}
+
+type JobEnergyReportStruct struct {
+	GroupBy string                  `json:"group_by"`
+	Groups  []*JobEnergyGroupStruct `json:"groups"`
+	Jobs    []*JobRecordStruct      `json:"jobs"`
+}
+
+// UpdateJobEnergy integrates the power monitor readings into the running job, called after each power monitor read
+func UpdateJobEnergy() {
+	cfg := config.Current()
+
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning {
+		return
+	}
+
+	energy := &job.Energy
+	now := time.Now()
+	last := energy.lastSample
+	energy.lastSample = now
+
+	if last.IsZero() || now.Sub(last) > maxEnergySampleGap {
+		return
+	}
+	hours := now.Sub(last).Hours()
+
+	total, hasTotal := dischargePower(batteryMonitorName())
+	drive, hasDrive := dischargePower(cfg.Energy.DriveMonitor)
+	cutter, hasCutter := dischargePower(cfg.Energy.CutterMonitor)
+
+	energy.Split = EnergySplitNone
+	if hasDrive && hasCutter {
+		energy.Split = EnergySplitMeasured
+	} else if hasTotal && hasCutter {
+		drive = math.Max(total-cutter, 0)
+		energy.Split = EnergySplitDerived
+	} else if hasTotal && hasDrive {
+		cutter = math.Max(total-drive, 0)
+		energy.Split = EnergySplitDerived
+	}
+
+	if !hasTotal {
+		total = drive + cutter
+	}
+
+	energy.TotalWh += total * hours
+	if energy.Split != EnergySplitNone {
+		energy.DriveWh += drive * hours
+		energy.CutterWh += cutter * hours
+	}
+
+	energy.updateRate()
+}
+
+// UpdateJobDistance adds the distance driven with the cutter running since the last navigation update to the running job, the area comes from the coverage map
+func UpdateJobDistance() {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning || MowerState.Cutter.Speed <= 0 {
+		if job != nil {
+			job.Energy.lastPose = nil
+		}
+		return
+	}
+
+	energy := &job.Energy
+	pose := MowerState.Pose
+	if energy.lastPose != nil {
+		d := distance(energy.lastPose.X, energy.lastPose.Y, pose.X, pose.Y)
+		energy.Distance += d
+	}
+	energy.lastPose = &pose
+}
+
+// JobHistory returns every finished job that has been recorded, oldest first, it must be called from the controller loop which is the only writer
+func JobHistory() []*JobRecordStruct {
+	var records []*JobRecordStruct
+
+	data, err := ioutil.ReadFile(jobHistoryPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read job history: %v", err)
+		}
+		return records
+	}
+
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		log.Errorf("unable to decode job history: %v", err)
+	}
+
+	return records
+}
+
+// JobEnergyReport groups the finished jobs by pattern, blade_height, grass_condition, zone or month and totals their energy use, it must be called from the controller loop
+func JobEnergyReport(groupBy string) (*JobEnergyReportStruct, error) {
+	if groupBy == "" {
+		groupBy = "pattern"
+	}
+
+	var keyOf func(*JobRecordStruct) string
+	switch groupBy {
+	case "pattern":
+		keyOf = func(r *JobRecordStruct) string { return r.Pattern }
+	case "blade_height":
+		keyOf = func(r *JobRecordStruct) string {
+			if r.BladeHeight == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(r.BladeHeight, 'f', -1, 64)
+		}
+	case "grass_condition":
+		keyOf = func(r *JobRecordStruct) string { return r.GrassCondition }
+	case "zone":
+		keyOf = func(r *JobRecordStruct) string { return r.Zone }
+	case "month":
+		keyOf = func(r *JobRecordStruct) string { return r.StartedAt.Format("2006-01") }
+	default:
+		return nil, errors.New("unable to group by " + groupBy)
+	}
+
+	report := &JobEnergyReportStruct{GroupBy: groupBy, Groups: []*JobEnergyGroupStruct{}, Jobs: JobHistory()}
+
+	groups := make(map[string]*JobEnergyGroupStruct)
+	for _, record := range report.Jobs {
+		key := keyOf(record)
+		if key == "" {
+			key = "unknown"
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &JobEnergyGroupStruct{Key: key}
+			groups[key] = group
+			report.Groups = append(report.Groups, group)
+		}
+
+		group.Jobs++
+		group.AreaMowed += record.Energy.AreaMowed
+		group.TotalWh += record.Energy.TotalWh
+		group.DriveWh += record.Energy.DriveWh
+		group.CutterWh += record.Energy.CutterWh
+	}
+
+	for _, group := range report.Groups {
+		if group.AreaMowed > 0 {
+			group.WhPerSquareMeter = math.Round(group.TotalWh/group.AreaMowed*1000) / 1000
+		}
+		group.AreaMowed = math.Round(group.AreaMowed*10) / 10
+		group.TotalWh = math.Round(group.TotalWh*100) / 100
+		group.DriveWh = math.Round(group.DriveWh*100) / 100
+		group.CutterWh = math.Round(group.CutterWh*100) / 100
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Key < report.Groups[j].Key })
+
+	return report, nil
+}
+
+// recordJobHistory appends a finished job to the history on disk
+func recordJobHistory(job *JobStruct) {
+	records := append(JobHistory(), &JobRecordStruct{
+		ID:              job.ID,
+		Zone:            job.Zone.Name,
+		Status:          job.Status,
+		StartedAt:       job.StartedAt,
+		EndedAt:         job.UpdatedAt,
+		PercentComplete: math.Round(job.PercentComplete()*10) / 10,
+		JobConditions:   job.JobConditions,
+		Energy:          job.Energy.rounded(),
+	})
+	if len(records) > maxJobHistory {
+		records = records[len(records)-maxJobHistory:]
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		log.Errorf("unable to encode job history: %v", err)
+		return
+	}
+
+	err = writeFileAtomic(jobHistoryPath(), data)
+	if err != nil {
+		log.Errorf("unable to write job history: %v", err)
+		return
+	}
+
+	log.Infof("job %v: used %.2fWh over %.1fm2", job.ID, job.Energy.TotalWh, job.Energy.AreaMowed)
+}
+
+func (e JobEnergyStruct) rounded() JobEnergyStruct {
+	return JobEnergyStruct{
+		TotalWh:          math.Round(e.TotalWh*1000) / 1000,
+		DriveWh:          math.Round(e.DriveWh*1000) / 1000,
+		CutterWh:         math.Round(e.CutterWh*1000) / 1000,
+		Split:            e.Split,
+		Distance:         math.Round(e.Distance*100) / 100,
+		AreaMowed:        math.Round(e.AreaMowed*100) / 100,
+		WhPerSquareMeter: math.Round(e.WhPerSquareMeter*10000) / 10000,
+	}
+}
+
+func (e *JobEnergyStruct) updateRate() {
+	if e.AreaMowed > 0 {
+		e.WhPerSquareMeter = e.TotalWh / e.AreaMowed
+	}
+}
+
+// dischargePower is the power drawn through a monitor channel in watts, charging current is not counted
+func dischargePower(monitor string) (float64, bool) {
+	if monitor == "" {
+		return 0, false
+	}
+
+	channel, ok := MowerState.Power[monitor]
+	if !ok {
+		return 0, false
+	}
+
+	return math.Max(channel.Voltage*channel.Current, 0), true
+}
+
+func batteryMonitorName() string {
+	cfg := config.Current()
+
+	if cfg.Battery.Monitor != "" {
+		return cfg.Battery.Monitor
+	}
+
+	return defaultBatteryMonitor
+}
+
+func jobHistoryPath() string {
+	return filepath.Join(config.Current().Mower.DataDirectory, jobHistoryFile)
+}
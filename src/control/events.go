@@ -0,0 +1,342 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	EventSeverityInfo     = "info"
+	EventSeverityWarning  = "warning"
+	EventSeverityCritical = "critical"
+
+	EventTypeFault         = "fault"
+	EventTypeEmergencyStop = "estop"
+	EventTypeMode          = "mode"
+	EventTypeDock          = "dock"
+	EventTypeJob           = "job"
+	EventTypeGeofence      = "geofence"
+	EventTypeBattery       = "battery"
+	EventTypeControl       = "control"
+	EventTypeSystem        = "system"
+
+	TopicEvents = "events"
+
+	eventDirectory = "events"
+	eventFile      = "events.jsonl"
+
+	// KB
+	defaultEventFileSize = 1024
+	defaultEventFiles    = 5
+
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+
+	// events waiting for the writer, the loop never waits on the disk unless this many pile up
+	eventQueueSize = 1024
+	// how long shutdown waits for queued events to be written
+	eventFlushTimeout = time.Second
+)
+
+var (
+	eventSeverity = map[string]int{
+		EventSeverityInfo:     0,
+		EventSeverityWarning:  1,
+		EventSeverityCritical: 2,
+	}
+
+	// held by the writer while it appends or rotates and by readers while they scan, never by the controller loop
+	eventLock sync.Mutex
+	// events recorded on the loop, written out by eventWriter
+	eventQueue   = make(chan EventStruct, eventQueueSize)
+	eventPending sync.WaitGroup
+
+	// owned by the controller loop, seeded from the files by StartEvents
+	lastEventID int64
+)
+
+// EventStruct is one entry in the persistent event log
+type EventStruct struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+	// whatever the event carries beyond the message, eg. the protection or control event
+	Details interface{} `json:"details,omitempty"`
+}
+
+// EventQuery filters the event log, zero values match everything
+type EventQuery struct {
+	Since time.Time
+	Until time.Time
+	// the least severity returned
+	Severity string
+	Types    []string
+	Limit    int
+}
+
+// StartEvents carries the event numbering on from the files and starts the writer, it runs before the controller loop starts
+func StartEvents() {
+	eventLock.Lock()
+	lastEventID = readLastEventID()
+	eventLock.Unlock()
+
+	go eventWriter()
+}
+
+// RecordEvent queues an event for the log and pushes it to websocket clients, it must be called from the controller loop
+func RecordEvent(severity string, kind string, message string, details interface{}) {
+	lastEventID++
+
+	event := EventStruct{
+		ID:       lastEventID,
+		Time:     time.Now(),
+		Severity: severity,
+		Type:     kind,
+		Message:  message,
+		Details:  details,
+	}
+
+	eventPending.Add(1)
+	eventQueue <- event
+
+	wsBroadcast(Envelope{Type: MessageTypeEvent, Topic: TopicEvents, Payload: event},
+		EventMessage{Event: event, Namespace: "mower", Mutation: "addEvent"})
+}
+
+// eventWriter appends queued events to the log so a slow disk or a long query never holds up the controller loop
+func eventWriter() {
+	for event := range eventQueue {
+		eventLock.Lock()
+		if err := appendEvent(event); err != nil {
+			log.Errorf("unable to write event log: %v", err)
+		}
+		eventLock.Unlock()
+
+		eventPending.Done()
+	}
+}
+
+// flushEvents waits for the queued events to be written, it is called from the controller loop at shutdown so nothing is queued meanwhile
+func flushEvents() {
+	done := make(chan bool)
+	go func() {
+		eventPending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(eventFlushTimeout):
+		log.Warnf("shutting down with %v events not yet written", len(eventQueue))
+	}
+}
+
+// Events reads the log, newest first, up to query.Limit events
+func Events(query EventQuery) ([]EventStruct, error) {
+	if query.Severity != "" {
+		if _, ok := eventSeverity[query.Severity]; !ok {
+			return nil, fmt.Errorf("severity must be %v, %v or %v", EventSeverityInfo, EventSeverityWarning, EventSeverityCritical)
+		}
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultEventLimit
+	}
+	if query.Limit > maxEventLimit {
+		query.Limit = maxEventLimit
+	}
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	// the oldest rotated file first, keeping only the newest matches as we go
+	var events []EventStruct
+	for i := eventFiles() - 1; i >= 0; i-- {
+		err := readEvents(eventPath(i), func(event EventStruct) {
+			if !query.matches(event) {
+				return
+			}
+
+			events = append(events, event)
+			if len(events) > query.Limit {
+				events = events[1:]
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	newestFirst := make([]EventStruct, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, events[i])
+	}
+
+	return newestFirst, nil
+}
+
+// checkTransitions records mode and dock status changes whatever caused them, it runs after everything the controller loop does
+func checkTransitions() {
+	m := MowerController
+
+	if MowerState.Mode != m.lastMode {
+		if m.lastMode != "" {
+			RecordEvent(EventSeverityInfo, EventTypeMode, "mode "+m.lastMode+" -> "+MowerState.Mode, nil)
+		}
+		m.lastMode = MowerState.Mode
+	}
+
+	if MowerState.Dock.Status != m.lastDockStatus {
+		if m.lastDockStatus != "" {
+			severity := EventSeverityInfo
+			if MowerState.Dock.Status == DockStatusFailed {
+				severity = EventSeverityWarning
+			}
+			RecordEvent(severity, EventTypeDock, "dock "+m.lastDockStatus+" -> "+MowerState.Dock.Status, MowerState.Dock)
+		}
+		m.lastDockStatus = MowerState.Dock.Status
+	}
+}
+
+func (q *EventQuery) matches(event EventStruct) bool {
+	if !q.Since.IsZero() && event.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && event.Time.After(q.Until) {
+		return false
+	}
+	if eventSeverity[event.Severity] < eventSeverity[q.Severity] {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+
+	for _, kind := range q.Types {
+		if kind == event.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendEvent must be called by the writer with eventLock held, the file is rotated once it passes events.maxFileSize
+func appendEvent(event EventStruct) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	path := eventPath(0)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(data)) > eventFileSize() {
+		rotateEvents()
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// rotateEvents shifts every file up one, the oldest falls off the end
+func rotateEvents() {
+	files := eventFiles()
+	os.Remove(eventPath(files - 1))
+
+	for i := files - 1; i > 0; i-- {
+		err := os.Rename(eventPath(i-1), eventPath(i))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("unable to rotate event log: %v", err)
+		}
+	}
+}
+
+// readEvents calls fn for each event in path, a missing file has no events and a damaged line is skipped
+func readEvents(path string, fn func(event EventStruct)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event EventStruct
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		fn(event)
+	}
+
+	return scanner.Err()
+}
+
+// readLastEventID carries the numbering on from before a restart
+func readLastEventID() int64 {
+	var last int64
+	for i := eventFiles() - 1; i >= 0; i-- {
+		readEvents(eventPath(i), func(event EventStruct) {
+			if event.ID > last {
+				last = event.ID
+			}
+		})
+	}
+
+	return last
+}
+
+// eventPath is the current file for 0, and the rotated files after it
+func eventPath(n int) string {
+	name := eventFile
+	if n > 0 {
+		name += "." + strconv.Itoa(n)
+	}
+
+	return filepath.Join(config.Current().Mower.DataDirectory, eventDirectory, name)
+}
+
+func eventFileSize() int64 {
+	cfg := config.Current()
+
+	size := defaultEventFileSize
+	if cfg.Events.MaxFileSize > 0 {
+		size = cfg.Events.MaxFileSize
+	}
+
+	return int64(size) * 1024
+}
+
+func eventFiles() int {
+	cfg := config.Current()
+
+	if cfg.Events.MaxFiles > 0 {
+		return cfg.Events.MaxFiles
+	}
+
+	return defaultEventFiles
+}
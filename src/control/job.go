@@ -0,0 +1,362 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	ModeManual     = "manual"
+	ModeAutonomous = "autonomous"
+
+	JobStatusRunning   = "running"
+	JobStatusPaused    = "paused"
+	JobStatusAborted   = "aborted"
+	JobStatusCompleted = "completed"
+
+	jobStateFile = "job.json"
+
+	defaultJobCutterSpeed = 100
+)
+
+type Zone struct {
+	Name     string     `json:"name"`
+	Boundary []Waypoint `json:"boundary"`
+}
+
+type JobStruct struct {
+	ID     string     `json:"id"`
+	Zone   Zone       `json:"zone"`
+	Plan   []Waypoint `json:"plan"`
+	Status string     `json:"status"`
+
+	// index into Plan of the last waypoint we have driven through, -1 when none have been reached yet
+	CompletedWaypoint int `json:"completed_waypoint"`
+
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	JobConditions
+	Energy JobEnergyStruct `json:"energy"`
+
+	// Plan index that the active path follower's first waypoint corresponds to
+	planOffset int
+}
+
+type JobRequest struct {
+	Zone Zone       `json:"zone"`
+	Plan []Waypoint `json:"plan"`
+	JobConditions
+}
+
+// StartJob switches the mower into autonomous mode and begins driving the plan with the cutter on
+func StartJob(request JobRequest) error {
+	zone, plan := request.Zone, request.Plan
+	if len(plan) == 0 {
+		return errors.New("plan must contain at least one waypoint")
+	}
+
+	job := MowerController.job
+	if job != nil && (job.Status == JobStatusRunning || job.Status == JobStatusPaused) {
+		return errors.New("job " + job.ID + " is already " + job.Status)
+	}
+	if err := checkProtectionAllowsJob(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	MowerController.job = &JobStruct{
+		ID:                newJobID(now, job),
+		Zone:              zone,
+		Plan:              plan,
+		CompletedWaypoint: -1,
+		StartedAt:         now,
+		JobConditions:     request.JobConditions,
+	}
+
+	log.Infof("job %v: starting in zone %v with %v waypoints", MowerController.job.ID, zone.Name, len(plan))
+
+	runJob()
+	return nil
+}
+
+// PauseJob stops the mower and cutter, keeping progress so the job can be resumed
+func PauseJob() error {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning {
+		return errors.New("no running job to pause")
+	}
+
+	StopPath()
+	MowerState.Cutter.Speed = 0
+	MowerState.Mode = ModeManual
+
+	setJobStatus(JobStatusPaused)
+	return nil
+}
+
+// ResumeJob continues a paused job from its last completed waypoint
+func ResumeJob() error {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusPaused {
+		return errors.New("no paused job to resume")
+	}
+	if err := checkProtectionAllowsJob(); err != nil {
+		return err
+	}
+
+	runJob()
+	return nil
+}
+
+// AbortJob stops the mower and discards the job
+func AbortJob() error {
+	job := MowerController.job
+	if job == nil || (job.Status != JobStatusRunning && job.Status != JobStatusPaused) {
+		return errors.New("no active job to abort")
+	}
+
+	StopPath()
+	MowerState.Cutter.Speed = 0
+	MowerState.Mode = ModeManual
+
+	setJobStatus(JobStatusAborted)
+	return nil
+}
+
+// CurrentJob returns a copy of the most recent job, or nil if there has never been one
+func CurrentJob() *JobStruct {
+	if MowerController.job == nil {
+		return nil
+	}
+
+	job := *MowerController.job
+	job.Zone.Boundary = append([]Waypoint(nil), job.Zone.Boundary...)
+	job.Plan = append([]Waypoint(nil), job.Plan...)
+	return &job
+}
+
+// LoadJob restores the last persisted job, an interrupted job comes back paused so it never drives off on its own after a reboot
+func LoadJob() {
+	data, err := ioutil.ReadFile(jobStatePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read job state: %v", err)
+		}
+		return
+	}
+
+	var job JobStruct
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		log.Errorf("unable to decode job state: %v", err)
+		return
+	}
+
+	if job.Status == JobStatusRunning {
+		job.Status = JobStatusPaused
+	}
+
+	MowerController.job = &job
+	updateJobState()
+
+	log.Infof("job %v: restored as %v at waypoint %v of %v", job.ID, job.Status, job.CompletedWaypoint+1, len(job.Plan))
+}
+
+// runJob (re)starts the path follower from the last completed waypoint
+func runJob() {
+	job := MowerController.job
+
+	job.planOffset = job.CompletedWaypoint
+	if job.planOffset < 0 {
+		job.planOffset = 0
+	}
+
+	MowerState.Mode = ModeAutonomous
+	StopDrive()
+	MowerState.Cutter.Speed = defaultJobCutterSpeed
+
+	FollowPath(job.Plan[job.planOffset:])
+
+	setJobStatus(JobStatusRunning)
+}
+
+// updateJobProgress is called after each navigation update while a job is running
+func updateJobProgress(follower *PathFollowerStruct) {
+	job := MowerController.job
+	if job == nil || job.Status != JobStatusRunning {
+		return
+	}
+
+	completed := job.planOffset + follower.CurrentWaypoint() - 1
+	if follower.Arrived() {
+		completed = len(job.Plan) - 1
+	}
+
+	if completed > job.CompletedWaypoint {
+		job.CompletedWaypoint = completed
+		job.UpdatedAt = time.Now()
+		saveJob()
+	}
+
+	if follower.Arrived() {
+		MowerState.Cutter.Speed = 0
+		MowerState.Mode = ModeManual
+
+		setJobStatus(JobStatusCompleted)
+		return
+	}
+
+	updateJobState()
+}
+
+func setJobStatus(status string) {
+	job := MowerController.job
+	job.Status = status
+	job.UpdatedAt = time.Now()
+
+	log.Infof("job %v: %v", job.ID, status)
+
+	saveJob()
+	saveCoverage(job.Zone.Name)
+	updateJobState()
+
+	RecordEvent(EventSeverityInfo, EventTypeJob, "job "+job.ID+" in zone "+job.Zone.Name+" "+status, MowerState.Job)
+
+	if status == JobStatusCompleted || status == JobStatusAborted {
+		recordJobHistory(job)
+	}
+}
+
+// UpdateGeofence records the mower leaving the zone of the running job, and coming back into it
+func UpdateGeofence() {
+	job := MowerController.job
+	running := job != nil && job.Status == JobStatusRunning && len(job.Zone.Boundary) >= 3
+
+	outside := running && !pointInPolygon(MowerState.Pose.X, MowerState.Pose.Y, job.Zone.Boundary)
+	if outside == MowerController.outsideZone {
+		return
+	}
+	MowerController.outsideZone = outside
+
+	pose := MowerState.Pose
+	if outside {
+		log.Warnf("job %v: left zone %v at %.2f, %.2f", job.ID, job.Zone.Name, pose.X, pose.Y)
+		RecordEvent(EventSeverityWarning, EventTypeGeofence,
+			fmt.Sprintf("left zone %v at %.2f, %.2f", job.Zone.Name, pose.X, pose.Y), pose)
+	} else if running {
+		RecordEvent(EventSeverityInfo, EventTypeGeofence,
+			fmt.Sprintf("back inside zone %v at %.2f, %.2f", job.Zone.Name, pose.X, pose.Y), pose)
+	}
+}
+
+// updateJobState copies the job progress into the published state
+func updateJobState() {
+	job := MowerController.job
+
+	MowerState.Job.ID = job.ID
+	MowerState.Job.Zone = job.Zone.Name
+	MowerState.Job.Status = job.Status
+	MowerState.Job.Waypoint = job.CompletedWaypoint + 1
+	MowerState.Job.WaypointCount = len(job.Plan)
+	MowerState.Job.PercentComplete = math.Round(job.PercentComplete()*10) / 10
+	MowerState.Job.EnergyWh = math.Round(job.Energy.TotalWh*100) / 100
+	MowerState.Job.AreaMowed = math.Round(job.Energy.AreaMowed*10) / 10
+}
+
+// PercentComplete is the share of the plan length driven through the last completed waypoint
+func (j *JobStruct) PercentComplete() float64 {
+	if j.CompletedWaypoint >= len(j.Plan)-1 {
+		return 100
+	}
+
+	total := pathLength(j.Plan)
+	if total == 0 || j.CompletedWaypoint <= 0 {
+		return 0
+	}
+
+	return 100 * pathLength(j.Plan[:j.CompletedWaypoint+1]) / total
+}
+
+func saveJob() {
+	data, err := json.MarshalIndent(MowerController.job, "", "  ")
+	if err != nil {
+		log.Errorf("unable to encode job state: %v", err)
+		return
+	}
+
+	err = writeFileAtomic(jobStatePath(), data)
+	if err != nil {
+		log.Errorf("unable to write job state: %v", err)
+	}
+}
+
+// newJobID names a job after the second it started, a job started in the same second as the previous one gets a sequence number
+func newJobID(now time.Time, previous *JobStruct) string {
+	id := now.Format("20060102-150405")
+	if previous == nil || !strings.HasPrefix(previous.ID, id) {
+		return id
+	}
+
+	sequence := 1
+	if suffix := strings.TrimPrefix(previous.ID, id); suffix != "" {
+		if n, err := strconv.Atoi(strings.TrimPrefix(suffix, "-")); err == nil {
+			sequence = n
+		}
+	}
+
+	return fmt.Sprintf("%v-%v", id, sequence+1)
+}
+
+func jobStatePath() string {
+	return filepath.Join(config.Current().Mower.DataDirectory, jobStateFile)
+}
+
+// writeFileAtomic writes to a temporary file, syncs it and renames it into place so a power cut never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func pathLength(waypoints []Waypoint) float64 {
+	total := 0.0
+	for i := 1; i < len(waypoints); i++ {
+		total += distance(waypoints[i-1].X, waypoints[i-1].Y, waypoints[i].X, waypoints[i].Y)
+	}
+
+	return total
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCurrentJobIsACopy(t *testing.T) {
+	startTestController(t)
+
+	var job *JobStruct
+	var plan, boundary Waypoint
+	var err error
+	Do(func() {
+		err = StartJob(JobRequest{
+			Zone: Zone{Name: "copy", Boundary: []Waypoint{{X: -1, Y: -1}, {X: 5, Y: -1}, {X: 5, Y: 5}}},
+			Plan: []Waypoint{{X: 2, Y: 0}, {X: 2, Y: 2}},
+		})
+		if err != nil {
+			return
+		}
+
+		job = CurrentJob()
+		job.Plan[0].X = 99
+		job.Zone.Boundary[0].X = 99
+		plan, boundary = MowerController.job.Plan[0], MowerController.job.Zone.Boundary[0]
+
+		AbortJob()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.X != 2 || boundary.X != -1 {
+		t.Fatalf("editing the copy changed the running job to plan %v and boundary %v", plan, boundary)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state", "job.json")
+	for _, data := range []string{`{"id":"one"}`, `{"id":"two"}`} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"id":"two"}` {
+		t.Errorf("file holds %s, want the last write", data)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("%v files left in the directory, want only the written one", len(files))
+	}
+}
+
+func TestNewJobID(t *testing.T) {
+	now := time.Date(2026, 6, 1, 10, 30, 0, 0, time.UTC)
+
+	first := newJobID(now, nil)
+	second := newJobID(now.Add(200*time.Millisecond), &JobStruct{ID: first})
+	third := newJobID(now.Add(400*time.Millisecond), &JobStruct{ID: second})
+	later := newJobID(now.Add(time.Second), &JobStruct{ID: third})
+
+	want := []string{"20260601-103000", "20260601-103000-2", "20260601-103000-3", "20260601-103001"}
+	for i, id := range []string{first, second, third, later} {
+		if id != want[i] {
+			t.Errorf("job %v is %v, want %v", i, id, want[i])
+		}
+	}
+}
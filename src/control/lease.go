@@ -0,0 +1,191 @@
+package control
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	LeaseReasonAcquired     = "acquired"
+	LeaseReasonReleased     = "released"
+	LeaseReasonTakeover     = "takeover"
+	LeaseReasonExpired      = "expired"
+	LeaseReasonDisconnected = "disconnected"
+
+	// the holder has to send a command this often or the lease lapses
+	defaultLeaseTimeout = 30 * time.Second
+)
+
+// ControllerIdentity identifies whoever is sending commands
+type ControllerIdentity struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+	// the account the client authenticated as and its role
+	User string `json:"user,omitempty"`
+	Role string `json:"role,omitempty"`
+}
+
+type ControlPayload struct {
+	// take the lease even if another client holds it
+	Takeover bool `json:"takeover"`
+}
+
+type ControlEvent struct {
+	Time     time.Time           `json:"time"`
+	Reason   string              `json:"reason"`
+	Holder   *ControllerIdentity `json:"holder"`
+	Previous *ControllerIdentity `json:"previous,omitempty"`
+}
+
+// leaseStruct is the driving authority, only its holder may send commands that change anything
+type leaseStruct struct {
+	holder     ControllerIdentity
+	acquiredAt time.Time
+	renewedAt  time.Time
+}
+
+// AcquireControl gives the caller the lease, taking it from another holder is only allowed with takeover
+func AcquireControl(caller ControllerIdentity, takeover bool) error {
+	lease := MowerController.lease
+	if lease != nil && lease.holder.ID == caller.ID {
+		lease.renewedAt = time.Now()
+		updateControlState()
+		return nil
+	}
+
+	reason := LeaseReasonAcquired
+	var previous *ControllerIdentity
+	if lease != nil {
+		if !takeover {
+			return errors.New("control is held by " + describeIdentity(lease.holder))
+		}
+		if !config.Current().Control.AllowTakeover {
+			return errors.New("takeover is disabled, control is held by " + describeIdentity(lease.holder))
+		}
+
+		holder := lease.holder
+		previous = &holder
+		reason = LeaseReasonTakeover
+
+		// the new holder starts from a standstill rather than inheriting whatever the last one was doing
+		StopDrive()
+	}
+
+	now := time.Now()
+	MowerController.lease = &leaseStruct{holder: caller, acquiredAt: now, renewedAt: now}
+
+	leaseChanged(reason, previous)
+	return nil
+}
+
+// ReleaseControl gives up the lease if the caller holds it
+func ReleaseControl(caller ControllerIdentity) error {
+	lease := MowerController.lease
+	if lease == nil || lease.holder.ID != caller.ID {
+		return errors.New("control is not held by " + describeIdentity(caller))
+	}
+
+	releaseControl(LeaseReasonReleased)
+	return nil
+}
+
+// checkControl renews the caller's lease, a free lease is picked up by whoever sends the first command
+func checkControl(caller ControllerIdentity) error {
+	lease := MowerController.lease
+	if lease == nil {
+		return AcquireControl(caller, false)
+	}
+	if lease.holder.ID != caller.ID {
+		return errors.New("control is held by " + describeIdentity(lease.holder))
+	}
+
+	lease.renewedAt = time.Now()
+	updateControlState()
+	return nil
+}
+
+// checkControlLease lapses a lease whose holder has gone quiet, called from the publish tick
+func checkControlLease() {
+	lease := MowerController.lease
+	if lease != nil && time.Since(lease.renewedAt) > leaseTimeout() {
+		// nobody is left to stop whatever the holder had the mower doing
+		StopDrive()
+		releaseControl(LeaseReasonExpired)
+	}
+}
+
+// clientDisconnected drops the lease of a client that went away, stopping the mower it was driving
+func clientDisconnected(caller ControllerIdentity) {
+	record(RecordDisconnect, caller)
+
+	lease := MowerController.lease
+	if lease != nil && lease.holder.ID == caller.ID {
+		StopDrive()
+		releaseControl(LeaseReasonDisconnected)
+	}
+}
+
+func releaseControl(reason string) {
+	holder := MowerController.lease.holder
+	MowerController.lease = nil
+
+	leaseChanged(reason, &holder)
+}
+
+func leaseChanged(reason string, previous *ControllerIdentity) {
+	updateControlState()
+
+	event := ControlEvent{Time: time.Now(), Reason: reason, Holder: MowerState.Control.Holder, Previous: previous}
+	who := previous
+	if event.Holder != nil {
+		who = event.Holder
+	}
+	log.Infof("control: %v by %v", reason, describeIdentity(*who))
+	RecordEvent(EventSeverityInfo, EventTypeControl, "control "+reason+" by "+describeIdentity(*who), event)
+
+	wsBroadcast(Envelope{Type: MessageTypeEvent, Topic: TopicControl, Payload: event},
+		EventMessage{Event: event, Namespace: "mower", Mutation: "setControlEvent"})
+}
+
+// updateControlState copies the lease into the published state, the pointers are replaced so copies of the state stay consistent
+func updateControlState() {
+	lease := MowerController.lease
+	if lease == nil {
+		MowerState.Control.Holder = nil
+		MowerState.Control.AcquiredAt = nil
+		MowerState.Control.ExpiresAt = nil
+		return
+	}
+
+	holder := lease.holder
+	acquiredAt := lease.acquiredAt
+	expiresAt := lease.renewedAt.Add(leaseTimeout())
+
+	MowerState.Control.Holder = &holder
+	MowerState.Control.AcquiredAt = &acquiredAt
+	MowerState.Control.ExpiresAt = &expiresAt
+}
+
+func describeIdentity(identity ControllerIdentity) string {
+	if identity.Name != "" {
+		return identity.Name + " (" + identity.ID + ")"
+	}
+	if identity.User != "" {
+		return identity.User + " (" + identity.ID + ")"
+	}
+
+	return identity.ID
+}
+
+func leaseTimeout() time.Duration {
+	cfg := config.Current()
+
+	if cfg.Control.LeaseTimeout > 0 {
+		return time.Duration(cfg.Control.LeaseTimeout) * time.Second
+	}
+
+	return defaultLeaseTimeout
+}
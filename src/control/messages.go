@@ -1,12 +1,116 @@
 package control
 
+import (
+	"encoding/json"
+)
+
+const (
+	// ProtocolVersion is the newest websocket protocol we speak, clients that never send a hello are treated as version 0
+	ProtocolVersion = 1
+
+	MessageTypeHello   = "hello"
+	MessageTypeWelcome = "welcome"
+	MessageTypeCommand = "command"
+	MessageTypeAck     = "ack"
+	MessageTypeError   = "error"
+	MessageTypeState   = "state"
+	MessageTypeEvent   = "event"
+
+	MessageTypeSubscribe   = "subscribe"
+	MessageTypeUnsubscribe = "unsubscribe"
+
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeUnsupportedVersion = "unsupported_version"
+	ErrorCodeUnknownMethod      = "unknown_method"
+	ErrorCodeInvalidPayload     = "invalid_payload"
+	ErrorCodeRejected           = "rejected"
+	ErrorCodeNotInControl       = "not_in_control"
+	ErrorCodeForbidden          = "forbidden"
+
+	TopicState      = "state"
+	TopicProtection = "protection"
+	TopicControl    = "control"
+)
+
+var (
+	supportedProtocolVersions = []int{ProtocolVersion}
+)
+
+// StateMessage is the version 0 state push, shaped as a Vuex mutation for the frontend websocket plugin
 type StateMessage struct {
 	*MowerStateStruct
 	Namespace string `json:"namespace"`
 	Mutation  string `json:"mutation"`
 }
 
+// EventMessage is the version 0 event push
+type EventMessage struct {
+	Event     interface{} `json:"event"`
+	Namespace string      `json:"namespace"`
+	Mutation  string      `json:"mutation"`
+}
+
+// CommandErrorMessage is the version 0 reply to a command that was refused, successful commands only show in the next state push
+type CommandErrorMessage struct {
+	Method    string         `json:"method"`
+	Error     *ProtocolError `json:"error"`
+	Namespace string         `json:"namespace"`
+	Mutation  string         `json:"mutation"`
+}
+
+// CommandMessage is the version 0 command, value is parsed per method
 type CommandMessage struct {
 	Method string `json:"method"`
 	Value  string `json:"value"`
 }
+
+// Envelope wraps every message of protocol version 1 and later
+type Envelope struct {
+	Version int            `json:"v"`
+	Type    string         `json:"type"`
+	ID      string         `json:"id,omitempty"`
+	Method  string         `json:"method,omitempty"`
+	Topic   string         `json:"topic,omitempty"`
+	Payload interface{}    `json:"payload,omitempty"`
+	Error   *ProtocolError `json:"error,omitempty"`
+
+	// set on subscribed topics, a delta payload only carries the fields that changed since the previous seq
+	Delta bool `json:"delta,omitempty"`
+	Seq   int  `json:"seq,omitempty"`
+}
+
+// incomingEnvelope is an Envelope with the payload left undecoded until we know the method
+type incomingEnvelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Method  string          `json:"method"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+type HelloPayload struct {
+	Client   string `json:"client"`
+	Versions []int  `json:"versions"`
+}
+
+// CapabilitiesStruct is sent in reply to a hello so the client knows what it can ask for
+type CapabilitiesStruct struct {
+	Version  int      `json:"version"`
+	Versions []int    `json:"versions"`
+	Name     string   `json:"name"`
+	Methods  []string `json:"methods"`
+	Topics   []string `json:"topics"`
+	Events   []string `json:"events"`
+
+	// how this client shows up as the control lease holder
+	Identity ControllerIdentity `json:"identity"`
+}
@@ -1,6 +1,8 @@
 package control
 
-import ()
+import (
+	"time"
+)
 
 type MowerStateStruct struct {
 	Platform struct {
@@ -39,7 +41,19 @@ type MowerStateStruct struct {
 		VoltageWarn    float64 `json:"voltage_warn"`
 		Voltage        float64 `json:"voltage"`
 		Current        float64 `json:"current"`
+
+		// percent, 0-100
+		StateOfCharge float64 `json:"state_of_charge"`
+		// Ah
+		RemainingCapacity float64 `json:"remaining_capacity"`
+
+		// predicted seconds until VoltageWarn, -1 while unknown
+		RemainingRuntime float64 `json:"remaining_runtime"`
+
+		// C from the pack thermistor, null when none is fitted
+		Temperature *float64 `json:"temperature"`
 	} `json:"battery"`
+	Power   map[string]PowerChannelStruct `json:"power"`
 	Compass struct {
 		Status  string `json:"status"`
 		Bearing string `json:"bearing"`
@@ -48,13 +62,60 @@ type MowerStateStruct struct {
 		Status      string `json:"status"`
 		Coordinates string `json:"coordinates"`
 	} `json:"gps"`
+	// the last MPU9250 reading, x, y, z in g, degrees/s and uT, the temperature is the chip's own in C
+	IMU struct {
+		Accelerometer [3]float64 `json:"accelerometer"`
+		Gyroscope     [3]float64 `json:"gyroscope"`
+		Magnetometer  [3]float64 `json:"magnetometer"`
+		Temperature   float64    `json:"temperature"`
+		Updated       time.Time  `json:"updated"`
+	} `json:"imu"`
 	Drive struct {
 		Speed     int    `json:"speed"`
 		Direction string `json:"direction"`
+
+		// rate limited joystick velocity and the left/right wheel outputs it mixes to, -1..1
+		Command VelocityCommand `json:"command"`
+		Left    float64         `json:"left"`
+		Right   float64         `json:"right"`
 	} `json:"drive"`
 	Cutter struct {
 		Speed int `json:"speed"`
 	} `json:"cutter"`
+	Pose       Pose `json:"pose"`
+	Navigation struct {
+		Status          string          `json:"status"`
+		Waypoint        int             `json:"waypoint"`
+		WaypointCount   int             `json:"waypoint_count"`
+		CrossTrackError float64         `json:"cross_track_error"`
+		Command         VelocityCommand `json:"command"`
+	} `json:"navigation"`
+	Mode string `json:"mode"`
+	Job  struct {
+		ID              string  `json:"id"`
+		Zone            string  `json:"zone"`
+		Status          string  `json:"status"`
+		Waypoint        int     `json:"waypoint"`
+		WaypointCount   int     `json:"waypoint_count"`
+		PercentComplete float64 `json:"percent_complete"`
+		PercentCovered  float64 `json:"percent_covered"`
+		EnergyWh        float64 `json:"energy_wh"`
+		AreaMowed       float64 `json:"area_mowed"`
+	} `json:"job"`
+	Dock struct {
+		Status   string `json:"status"`
+		Reason   string `json:"reason"`
+		Charging bool   `json:"charging"`
+	} `json:"dock"`
+	Control struct {
+		Holder     *ControllerIdentity `json:"holder"`
+		AcquiredAt *time.Time          `json:"acquired_at"`
+		ExpiresAt  *time.Time          `json:"expires_at"`
+	} `json:"control"`
+	Protection struct {
+		Level  string   `json:"level"`
+		Faults []string `json:"faults"`
+	} `json:"protection"`
 }
 
 var (
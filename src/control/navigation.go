@@ -0,0 +1,252 @@
+package control
+
+//
+// Pure pursuit path tracking, see "Implementation of the Pure Pursuit Path Tracking Algorithm" (R. Craig Coulter, CMU-RI-TR-92-01)
+//
+// All positions are in meters on a local flat plane, headings are in radians counter-clockwise from the +X axis.
+//
+
+import (
+	"math"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	defaultLookaheadDistance  = 0.5
+	defaultWaypointTolerance  = 0.25
+	defaultGoalTolerance      = 0.10
+	defaultMaxLinearVelocity  = 0.5
+	defaultMaxAngularVelocity = 1.0
+
+	// never crawl slower than this while approaching the goal, otherwise we may never arrive
+	minApproachVelocityRatio = 0.2
+)
+
+type Waypoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type Pose struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Heading float64 `json:"heading"`
+}
+
+type VelocityCommand struct {
+	Linear  float64 `json:"linear"`
+	Angular float64 `json:"angular"`
+}
+
+type PathFollowerStruct struct {
+	Waypoints []Waypoint
+
+	LookaheadDistance  float64
+	WaypointTolerance  float64
+	GoalTolerance      float64
+	MaxLinearVelocity  float64
+	MaxAngularVelocity float64
+
+	// index of the waypoint we are currently driving towards
+	target int
+
+	crossTrackError float64
+	arrived         bool
+}
+
+// NewPathFollower creates a pure pursuit tracker for the supplied waypoints using the navigation settings from config.json
+func NewPathFollower(waypoints []Waypoint) *PathFollowerStruct {
+	p := &PathFollowerStruct{
+		Waypoints: waypoints,
+
+		arrived: len(waypoints) == 0,
+	}
+	p.Configure()
+
+	return p
+}
+
+// Configure (re)reads the navigation settings from config.json, a follower that is part way along a path carries on with the new ones
+func (p *PathFollowerStruct) Configure() {
+	cfg := config.Current()
+
+	p.LookaheadDistance = defaultLookaheadDistance
+	p.WaypointTolerance = defaultWaypointTolerance
+	p.GoalTolerance = defaultGoalTolerance
+	p.MaxLinearVelocity = defaultMaxLinearVelocity
+	p.MaxAngularVelocity = defaultMaxAngularVelocity
+
+	if cfg != nil {
+		nav := cfg.Navigation
+		if nav.LookaheadDistance > 0 {
+			p.LookaheadDistance = nav.LookaheadDistance
+		}
+		if nav.WaypointTolerance > 0 {
+			p.WaypointTolerance = nav.WaypointTolerance
+		}
+		if nav.GoalTolerance > 0 {
+			p.GoalTolerance = nav.GoalTolerance
+		}
+		if nav.MaxLinearVelocity > 0 {
+			p.MaxLinearVelocity = nav.MaxLinearVelocity
+		}
+		if nav.MaxAngularVelocity > 0 {
+			p.MaxAngularVelocity = nav.MaxAngularVelocity
+		}
+	}
+}
+
+// Update computes the velocity command that steers the mower from pose back onto the path
+func (p *PathFollowerStruct) Update(pose Pose) VelocityCommand {
+	if p.arrived {
+		return VelocityCommand{}
+	}
+
+	goal := p.Waypoints[len(p.Waypoints)-1]
+	if distance(pose.X, pose.Y, goal.X, goal.Y) <= p.GoalTolerance {
+		p.target = len(p.Waypoints) - 1
+		p.crossTrackError = 0
+		p.arrived = true
+		return VelocityCommand{}
+	}
+
+	p.advanceTarget(pose)
+
+	// project the mower onto the segment we are on, the first segment starts from wherever we are
+	start := Waypoint{X: pose.X, Y: pose.Y}
+	if p.target > 0 {
+		start = p.Waypoints[p.target-1]
+	}
+	end := p.Waypoints[p.target]
+
+	closest, _ := projectOntoSegment(pose, start, end)
+	p.crossTrackError = signedCrossTrack(pose, start, end)
+
+	lookahead := p.lookaheadPoint(p.target, p.LookaheadDistance, closest)
+
+	// transform the lookahead point into the mower frame
+	dx := lookahead.X - pose.X
+	dy := lookahead.Y - pose.Y
+	localX := math.Cos(pose.Heading)*dx + math.Sin(pose.Heading)*dy
+	localY := -math.Sin(pose.Heading)*dx + math.Cos(pose.Heading)*dy
+
+	// lookahead point is behind us, turn in place until it is in front
+	if localX <= 0 {
+		return VelocityCommand{Linear: 0, Angular: math.Copysign(p.MaxAngularVelocity, localY)}
+	}
+
+	linear := p.MaxLinearVelocity
+	remaining := p.remainingDistance(pose)
+	if remaining < p.LookaheadDistance {
+		linear *= math.Max(remaining/p.LookaheadDistance, minApproachVelocityRatio)
+	}
+
+	lookaheadSquared := localX*localX + localY*localY
+	curvature := 2 * localY / lookaheadSquared
+	angular := linear * curvature
+
+	// keep the curvature when the turn rate is clipped by slowing down instead
+	if math.Abs(angular) > p.MaxAngularVelocity {
+		angular = math.Copysign(p.MaxAngularVelocity, angular)
+		linear = math.Abs(angular / curvature)
+	}
+
+	return VelocityCommand{Linear: linear, Angular: angular}
+}
+
+// CurrentWaypoint returns the index of the waypoint being driven towards
+func (p *PathFollowerStruct) CurrentWaypoint() int {
+	return p.target
+}
+
+// CrossTrackError returns the signed lateral distance from the active path segment, positive when the mower is left of the path
+func (p *PathFollowerStruct) CrossTrackError() float64 {
+	return p.crossTrackError
+}
+
+// Arrived reports whether the final waypoint has been reached within GoalTolerance
+func (p *PathFollowerStruct) Arrived() bool {
+	return p.arrived
+}
+
+// advanceTarget moves on to the next waypoint once the current one is within tolerance or has been passed
+func (p *PathFollowerStruct) advanceTarget(pose Pose) {
+	for p.target < len(p.Waypoints)-1 {
+		w := p.Waypoints[p.target]
+		if distance(pose.X, pose.Y, w.X, w.Y) <= p.WaypointTolerance {
+			p.target++
+			continue
+		}
+
+		// passed the end of the segment without getting close enough, carry on rather than circling back
+		if p.target > 0 {
+			start := p.Waypoints[p.target-1]
+			segment := distance(start.X, start.Y, w.X, w.Y)
+			if _, along := projectOntoSegment(pose, start, w); segment > 0 && along >= segment {
+				p.target++
+				continue
+			}
+		}
+
+		break
+	}
+}
+
+// lookaheadPoint walks the path from the segment ending at index target by the requested distance
+func (p *PathFollowerStruct) lookaheadPoint(target int, remaining float64, from Waypoint) Waypoint {
+	current := from
+	for i := target; i < len(p.Waypoints); i++ {
+		next := p.Waypoints[i]
+		segment := distance(current.X, current.Y, next.X, next.Y)
+		if segment >= remaining && segment > 0 {
+			ratio := remaining / segment
+			return Waypoint{X: current.X + (next.X-current.X)*ratio, Y: current.Y + (next.Y-current.Y)*ratio}
+		}
+		remaining -= segment
+		current = next
+	}
+
+	return p.Waypoints[len(p.Waypoints)-1]
+}
+
+// remainingDistance is the distance left to drive along the path to the final waypoint
+func (p *PathFollowerStruct) remainingDistance(pose Pose) float64 {
+	w := p.Waypoints[p.target]
+	total := distance(pose.X, pose.Y, w.X, w.Y)
+	for i := p.target + 1; i < len(p.Waypoints); i++ {
+		total += distance(p.Waypoints[i-1].X, p.Waypoints[i-1].Y, p.Waypoints[i].X, p.Waypoints[i].Y)
+	}
+
+	return total
+}
+
+// projectOntoSegment returns the closest point on the segment and its distance along the (unclamped) segment
+func projectOntoSegment(pose Pose, start Waypoint, end Waypoint) (closest Waypoint, along float64) {
+	dx := end.X - start.X
+	dy := end.Y - start.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return start, 0
+	}
+
+	along = ((pose.X-start.X)*dx + (pose.Y-start.Y)*dy) / length
+	clamped := math.Max(0, math.Min(along, length))
+
+	return Waypoint{X: start.X + dx*clamped/length, Y: start.Y + dy*clamped/length}, along
+}
+
+func signedCrossTrack(pose Pose, start Waypoint, end Waypoint) float64 {
+	dx := end.X - start.X
+	dy := end.Y - start.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return 0
+	}
+
+	return (dx*(pose.Y-start.Y) - dy*(pose.X-start.X)) / length
+}
+
+func distance(x1, y1, x2, y2 float64) float64 {
+	return math.Hypot(x2-x1, y2-y1)
+}
@@ -0,0 +1,134 @@
+package control
+
+import (
+	"math"
+
+	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/control/drivers"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/drivers/i2c"
+)
+
+const (
+	defaultBatteryMonitor = "battery"
+)
+
+type PowerChannelStruct struct {
+	Voltage float64 `json:"voltage"`
+	Current float64 `json:"current"`
+	Power   float64 `json:"power"`
+}
+
+type powerMonitorStruct struct {
+	name   string
+	driver *drivers.INA219Driver
+	last   PowerChannelStruct
+}
+
+// NewPowerMonitors builds an INA219 driver for every channel declared in config.json, or a single battery monitor on the default address when there are none
+func NewPowerMonitors(c i2c.Connector) []*powerMonitorStruct {
+	cfg := config.Current()
+
+	if len(cfg.PowerMonitors) == 0 {
+		return []*powerMonitorStruct{{name: defaultBatteryMonitor, driver: drivers.NewINA219Driver(c)}}
+	}
+
+	var monitors []*powerMonitorStruct
+	for _, channel := range cfg.PowerMonitors {
+		options := []func(i2c.Config){
+			drivers.WithINA219ShuntResistance(channel.ShuntResistance),
+			drivers.WithINA219MaxCurrent(channel.MaxCurrent),
+			drivers.WithINA219Averaging(channel.Averaging),
+		}
+		if channel.Bus > 0 {
+			options = append(options, i2c.WithBus(channel.Bus))
+		}
+		if channel.Address > 0 {
+			options = append(options, i2c.WithAddress(channel.Address))
+		}
+
+		switch channel.Gain {
+		case 0:
+			// picked from the max current
+		case 40:
+			options = append(options, drivers.WithINA219Gain(drivers.INA219_CONFIG_GAIN_1_40MV))
+		case 80:
+			options = append(options, drivers.WithINA219Gain(drivers.INA219_CONFIG_GAIN_2_80MV))
+		case 160:
+			options = append(options, drivers.WithINA219Gain(drivers.INA219_CONFIG_GAIN_4_160MV))
+		case 320:
+			options = append(options, drivers.WithINA219Gain(drivers.INA219_CONFIG_GAIN_8_320MV))
+		default:
+			log.Warnf("power monitor %v: unsupported gain %vmV, picking from max current", channel.Name, channel.Gain)
+		}
+
+		driver := drivers.NewINA219Driver(c, options...)
+		driver.SetName("INA219 " + channel.Name)
+
+		monitors = append(monitors, &powerMonitorStruct{name: channel.Name, driver: driver})
+	}
+
+	return monitors
+}
+
+// powerDevices returns the monitor drivers for registering with the robot platform
+func powerDevices(monitors []*powerMonitorStruct) []gobot.Device {
+	devices := make([]gobot.Device, 0, len(monitors))
+	for _, monitor := range monitors {
+		devices = append(devices, monitor.driver)
+	}
+
+	return devices
+}
+
+// ReadPowerMonitors samples every INA219 channel, it runs on the robot loop so it only touches the monitors themselves
+func ReadPowerMonitors() map[string]PowerChannelStruct {
+	// build a fresh map each time, the published one is never modified once it has been handed out
+	power := make(map[string]PowerChannelStruct, len(MowerController.powerMonitors))
+
+	for _, monitor := range MowerController.powerMonitors {
+		// keep the last good reading of anything that fails to read
+		channel := monitor.last
+
+		val, err := monitor.driver.GetLoadVoltage()
+		if err == nil {
+			channel.Voltage = math.Round(val*100) / 100
+		}
+		val, err = monitor.driver.GetCurrent()
+		if err == nil {
+			channel.Current = math.Round(val*100) / 100
+		}
+		val, err = monitor.driver.GetPower()
+		if err == nil {
+			channel.Power = math.Round(val*100) / 100
+		}
+
+		monitor.last = channel
+		power[monitor.name] = channel
+	}
+
+	return power
+}
+
+// UpdatePower runs everything that follows a new set of readings, from the power monitors or a replay
+func UpdatePower(power map[string]PowerChannelStruct) {
+	record(RecordPower, power)
+
+	SetPowerReadings(power)
+
+	UpdateBattery()
+	UpdateJobEnergy()
+
+	CheckProtection()
+}
+
+// SetPowerReadings publishes a set of power monitor readings, the battery channel also feeds MowerState.Battery
+func SetPowerReadings(power map[string]PowerChannelStruct) {
+	if channel, ok := power[batteryMonitorName()]; ok {
+		MowerState.Battery.Voltage = channel.Voltage
+		MowerState.Battery.Current = channel.Current
+	}
+
+	MowerState.Power = power
+}
@@ -0,0 +1,301 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	ProtectionLevelNone    = ""
+	ProtectionLevelWarning = "warning"
+	ProtectionLevelCutter  = "cutter"
+	ProtectionLevelStop    = "stop"
+
+	ProtectionRuleUndervoltage = "undervoltage"
+	ProtectionRuleOvercurrent  = "overcurrent"
+	ProtectionRuleSpike        = "spike"
+)
+
+var (
+	protectionSeverity = map[string]int{
+		ProtectionLevelNone:    0,
+		ProtectionLevelWarning: 1,
+		ProtectionLevelCutter:  2,
+		ProtectionLevelStop:    3,
+	}
+)
+
+type ProtectionEvent struct {
+	Time      time.Time `json:"time"`
+	Rule      string    `json:"rule"`
+	Monitor   string    `json:"monitor"`
+	Level     string    `json:"level"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Cleared   bool      `json:"cleared"`
+	Message   string    `json:"message"`
+}
+
+type protectionLevelStruct struct {
+	level     string
+	threshold float64
+	duration  time.Duration
+
+	since  time.Time
+	active bool
+}
+
+type protectionRuleStruct struct {
+	name       string
+	monitor    string
+	kind       string
+	hysteresis float64
+	levels     []*protectionLevelStruct
+
+	lastCurrent float64
+	hasLast     bool
+	// current draw before a spike, the spike clears once we are back down near it
+	baseline float64
+}
+
+// NewProtectionRules builds the rule set declared in config.json, rules with an unknown type or level are skipped
+func NewProtectionRules() []*protectionRuleStruct {
+	var rules []*protectionRuleStruct
+
+	for _, cfg := range config.Current().Protection.Rules {
+		if cfg.Type != ProtectionRuleUndervoltage && cfg.Type != ProtectionRuleOvercurrent && cfg.Type != ProtectionRuleSpike {
+			log.Warnf("protection rule %v: unknown type %v", cfg.Name, cfg.Type)
+			continue
+		}
+
+		rule := &protectionRuleStruct{
+			name:       cfg.Name,
+			monitor:    cfg.Monitor,
+			kind:       cfg.Type,
+			hysteresis: cfg.Hysteresis,
+		}
+		if rule.monitor == "" {
+			rule.monitor = defaultBatteryMonitor
+		}
+
+		for _, level := range cfg.Levels {
+			if _, ok := protectionSeverity[level.Level]; !ok || level.Level == ProtectionLevelNone {
+				log.Warnf("protection rule %v: unknown level %v", cfg.Name, level.Level)
+				continue
+			}
+
+			rule.levels = append(rule.levels, &protectionLevelStruct{
+				level:     level.Level,
+				threshold: level.Threshold,
+				duration:  time.Duration(level.Duration * float64(time.Second)),
+			})
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// ReloadProtectionRules rebuilds the rules after a config change, rules and levels that kept their name carry on from where they were so an active fault is not forgotten
+func ReloadProtectionRules() {
+	previous := make(map[string]*protectionRuleStruct)
+	for _, rule := range MowerController.protectionRules {
+		previous[rule.name] = rule
+	}
+
+	rules := NewProtectionRules()
+	for _, rule := range rules {
+		old, ok := previous[rule.name]
+		if !ok || old.monitor != rule.monitor || old.kind != rule.kind {
+			continue
+		}
+
+		rule.lastCurrent = old.lastCurrent
+		rule.hasLast = old.hasLast
+		rule.baseline = old.baseline
+
+		for _, level := range rule.levels {
+			for _, oldLevel := range old.levels {
+				if oldLevel.level == level.level {
+					level.since = oldLevel.since
+					level.active = oldLevel.active
+				}
+			}
+		}
+	}
+
+	MowerController.protectionRules = rules
+	log.Infof("protection: reloaded %v rules", len(rules))
+}
+
+// CheckProtection evaluates every rule against the latest power monitor readings and escalates or relaxes the protection level
+func CheckProtection() {
+	now := time.Now()
+	level := ProtectionLevelNone
+	var faults []string
+
+	for _, rule := range MowerController.protectionRules {
+		channel, ok := MowerState.Power[rule.monitor]
+		if !ok {
+			continue
+		}
+
+		ruleLevel := rule.evaluate(channel, now)
+		if ruleLevel != ProtectionLevelNone {
+			faults = append(faults, rule.name)
+		}
+		if protectionSeverity[ruleLevel] > protectionSeverity[level] {
+			level = ruleLevel
+		}
+	}
+
+	MowerState.Protection.Faults = faults
+
+	if level == MowerState.Protection.Level {
+		return
+	}
+
+	log.Warnf("protection: level %q -> %q", MowerState.Protection.Level, level)
+	MowerState.Protection.Level = level
+
+	applyProtection(level)
+}
+
+// ProtectionAllowsCutter reports whether the cutter may be started
+func ProtectionAllowsCutter() bool {
+	return protectionSeverity[MowerState.Protection.Level] < protectionSeverity[ProtectionLevelCutter]
+}
+
+// ProtectionAllowsDrive reports whether the drive motors may be moved
+func ProtectionAllowsDrive() bool {
+	return protectionSeverity[MowerState.Protection.Level] < protectionSeverity[ProtectionLevelStop]
+}
+
+// checkProtectionAllowsJob returns an error describing why a job cannot run right now
+func checkProtectionAllowsJob() error {
+	if !ProtectionAllowsCutter() {
+		return errors.New("protection level " + MowerState.Protection.Level + " is active")
+	}
+
+	return nil
+}
+
+func applyProtection(level string) {
+	if protectionSeverity[level] >= protectionSeverity[ProtectionLevelCutter] {
+		MowerState.Cutter.Speed = 0
+
+		// no point driving the plan if we are not cutting
+		if job := MowerController.job; job != nil && job.Status == JobStatusRunning {
+			PauseJob()
+		}
+	}
+
+	if protectionSeverity[level] >= protectionSeverity[ProtectionLevelStop] {
+		CancelReturnHome()
+		StopPath()
+
+		StopDrive()
+		MowerState.Mode = ModeManual
+	}
+}
+
+// evaluate steps every level of the rule and returns the highest active one
+func (r *protectionRuleStruct) evaluate(channel PowerChannelStruct, now time.Time) string {
+	value := channel.Voltage
+	if r.kind == ProtectionRuleOvercurrent {
+		value = channel.Current
+	} else if r.kind == ProtectionRuleSpike {
+		value = 0
+		if r.hasLast {
+			value = channel.Current - r.lastCurrent
+		}
+	}
+
+	highest := ProtectionLevelNone
+	for _, l := range r.levels {
+		if !l.active {
+			if r.tripped(l, value) {
+				if l.since.IsZero() {
+					l.since = now
+				}
+				if now.Sub(l.since) >= l.duration {
+					l.active = true
+					if r.kind == ProtectionRuleSpike {
+						r.baseline = r.lastCurrent
+					}
+					r.emit(l, value, false, now)
+				}
+			} else {
+				l.since = time.Time{}
+			}
+		} else if r.recovered(l, channel) {
+			l.active = false
+			l.since = time.Time{}
+			r.emit(l, value, true, now)
+		}
+
+		if l.active && protectionSeverity[l.level] > protectionSeverity[highest] {
+			highest = l.level
+		}
+	}
+
+	r.lastCurrent = channel.Current
+	r.hasLast = true
+
+	return highest
+}
+
+func (r *protectionRuleStruct) tripped(l *protectionLevelStruct, value float64) bool {
+	if r.kind == ProtectionRuleUndervoltage {
+		return value < l.threshold
+	}
+
+	return value > l.threshold
+}
+
+// recovered applies the hysteresis band so a reading hovering on the threshold does not flap
+func (r *protectionRuleStruct) recovered(l *protectionLevelStruct, channel PowerChannelStruct) bool {
+	switch r.kind {
+	case ProtectionRuleUndervoltage:
+		return channel.Voltage >= l.threshold+r.hysteresis
+	case ProtectionRuleOvercurrent:
+		return channel.Current <= l.threshold-r.hysteresis
+	default:
+		return channel.Current <= r.baseline+r.hysteresis
+	}
+}
+
+func (r *protectionRuleStruct) emit(l *protectionLevelStruct, value float64, cleared bool, now time.Time) {
+	event := ProtectionEvent{
+		Time:      now,
+		Rule:      r.name,
+		Monitor:   r.monitor,
+		Level:     l.level,
+		Value:     value,
+		Threshold: l.threshold,
+		Cleared:   cleared,
+	}
+
+	if cleared {
+		event.Message = fmt.Sprintf("%v on %v cleared", r.kind, r.monitor)
+	} else {
+		event.Message = fmt.Sprintf("%v on %v: %.2f past %.2f", r.kind, r.monitor, value, l.threshold)
+	}
+
+	log.Warnf("protection: %v %v %v", r.name, l.level, event.Message)
+
+	severity := EventSeverityCritical
+	if cleared {
+		severity = EventSeverityInfo
+	} else if l.level == ProtectionLevelWarning {
+		severity = EventSeverityWarning
+	}
+	RecordEvent(severity, EventTypeFault, r.name+" "+l.level+": "+event.Message, event)
+
+	wsBroadcast(Envelope{Type: MessageTypeEvent, Topic: TopicProtection, Payload: event},
+		EventMessage{Event: event, Namespace: "mower", Mutation: "addProtectionEvent"})
+}
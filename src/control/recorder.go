@@ -0,0 +1,296 @@
+package control
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+)
+
+const (
+	RecordSession     = "session"
+	RecordPower       = "power"
+	RecordIMU         = "imu"
+	RecordTemperature = "temperature"
+	RecordPose        = "pose"
+	RecordCommand     = "command"
+	RecordDisconnect  = "disconnect"
+	RecordState       = "state"
+
+	recordingVersion   = 1
+	recordingDirectory = "recordings"
+	recordingExtension = ".jsonl.gz"
+	// sessions are named after the local time they started
+	recordingTimeFormat = "20060102-150405"
+)
+
+// RecordStruct is one line of a recording, Data is the reading, command or state the kind names
+type RecordStruct struct {
+	Time time.Time       `json:"time"`
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// SessionRecord opens every recording with what a replay needs to start the controller the way the recording did
+type SessionRecord struct {
+	Version int    `json:"version"`
+	Mower   string `json:"mower"`
+	// the running config without credentials
+	Config config.ConfigStruct `json:"config"`
+	// the job restored at startup
+	Job *JobStruct `json:"job,omitempty"`
+}
+
+// CommandRecord is a command as the controller received it, whether or not it was allowed to run
+type CommandRecord struct {
+	Method  string             `json:"method"`
+	Caller  ControllerIdentity `json:"caller"`
+	Payload json.RawMessage    `json:"payload,omitempty"`
+	// why the command was refused, empty when it ran
+	Error string `json:"error,omitempty"`
+}
+
+// RecordingStruct describes a recorded session
+type RecordingStruct struct {
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"`
+	// still being written by this run
+	Active bool `json:"active"`
+}
+
+type recorderStruct struct {
+	name string
+	file *os.File
+	gzip *gzip.Writer
+}
+
+// startRecording opens a new session, it does nothing while replaying or with the recorder disabled
+func startRecording() {
+	cfg := config.Current()
+
+	if replaying != nil || !cfg.Recorder.Enabled || MowerController.recorder != nil {
+		return
+	}
+
+	err := os.MkdirAll(recordingPath(""), 0755)
+	if err != nil {
+		log.Errorf("unable to create recording directory: %v", err)
+		return
+	}
+	pruneRecordings()
+
+	name := time.Now().Format(recordingTimeFormat) + recordingExtension
+	file, err := os.OpenFile(recordingPath(name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("unable to start recording: %v", err)
+		return
+	}
+
+	MowerController.recorder = &recorderStruct{name: name, file: file, gzip: gzip.NewWriter(file)}
+
+	session := SessionRecord{
+		Version: recordingVersion,
+		Mower:   cfg.Mower.Name,
+		Config:  *cfg,
+		Job:     MowerController.job,
+	}
+	session.Config.Auth.Users = nil
+	session.Config.Auth.Tokens = nil
+	record(RecordSession, session)
+
+	log.Infof("recording to %v", name)
+}
+
+// stopRecording finishes the session so the file is complete
+func stopRecording() {
+	recorder := MowerController.recorder
+	if recorder == nil {
+		return
+	}
+	MowerController.recorder = nil
+
+	err := recorder.gzip.Close()
+	if closeErr := recorder.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("unable to finish recording %v: %v", recorder.name, err)
+	}
+}
+
+// record appends a reading, command or snapshot to the session, it must be called from the controller loop
+func record(kind string, data interface{}) {
+	recorder := MowerController.recorder
+	if recorder == nil {
+		return
+	}
+
+	line, err := json.Marshal(data)
+	if err == nil {
+		line, err = json.Marshal(RecordStruct{Time: time.Now(), Kind: kind, Data: line})
+	}
+	if err == nil {
+		_, err = recorder.gzip.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Errorf("unable to record %v, recording stopped: %v", kind, err)
+		stopRecording()
+	}
+}
+
+// recordState snapshots the state and flushes the session, so a power cut loses at most one publish interval
+func recordState() {
+	record(RecordState, MowerState)
+
+	if recorder := MowerController.recorder; recorder != nil {
+		if err := recorder.gzip.Flush(); err != nil {
+			log.Errorf("unable to flush recording, recording stopped: %v", err)
+			stopRecording()
+		}
+	}
+}
+
+// recordCommand records a command along with why it was refused
+func recordCommand(caller ControllerIdentity, method string, payload interface{}, err *ProtocolError) {
+	if MowerController.recorder == nil {
+		return
+	}
+
+	command := CommandRecord{Method: method, Caller: caller}
+	if payload != nil {
+		command.Payload, _ = json.Marshal(payload)
+	}
+	if err != nil {
+		command.Error = err.Message
+	}
+
+	record(RecordCommand, command)
+}
+
+// Recordings lists the recorded sessions, oldest first, it must be called from the controller loop
+func Recordings() ([]RecordingStruct, error) {
+	files, err := ioutil.ReadDir(recordingPath(""))
+	if os.IsNotExist(err) {
+		return []RecordingStruct{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []RecordingStruct{}
+	for _, file := range files {
+		started, ok := recordingStarted(file.Name())
+		if !ok {
+			continue
+		}
+
+		recording := RecordingStruct{Name: file.Name(), Started: started, Size: file.Size()}
+		if recorder := MowerController.recorder; recorder != nil && recorder.name == file.Name() {
+			recording.Active = true
+		}
+		recordings = append(recordings, recording)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Started.Before(recordings[j].Started)
+	})
+
+	return recordings, nil
+}
+
+// RecordingFile returns the path of a recorded session
+func RecordingFile(name string) (string, error) {
+	if _, ok := recordingStarted(name); !ok {
+		return "", errors.New("no recording " + name)
+	}
+
+	path := recordingPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.New("no recording " + name)
+	}
+
+	return path, nil
+}
+
+// readRecording calls fn for each record in path, a session cut short by a power cut ends at its last complete record
+func readRecording(path string, fn func(r RecordStruct) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var r RecordStruct
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	err = scanner.Err()
+	if err == io.ErrUnexpectedEOF {
+		log.Warnf("recording %v ends early, it was not closed cleanly", filepath.Base(path))
+		return nil
+	}
+
+	return err
+}
+
+// pruneRecordings removes the oldest sessions to leave room for a new one under recorder.maxSessions, 0 keeps them all
+func pruneRecordings() {
+	keep := config.Current().Recorder.MaxSessions
+	if keep <= 0 {
+		return
+	}
+
+	recordings, err := Recordings()
+	if err != nil {
+		log.Errorf("unable to list recordings: %v", err)
+		return
+	}
+
+	for len(recordings) >= keep {
+		if err := os.Remove(recordingPath(recordings[0].Name)); err != nil {
+			log.Errorf("unable to remove recording %v: %v", recordings[0].Name, err)
+		}
+		recordings = recordings[1:]
+	}
+}
+
+// recordingStarted reads the start time from a session name, anything that is not a session name is rejected
+func recordingStarted(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, recordingExtension) {
+		return time.Time{}, false
+	}
+
+	started, err := time.ParseInLocation(recordingTimeFormat, strings.TrimSuffix(name, recordingExtension), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return started, true
+}
+
+func recordingPath(name string) string {
+	return filepath.Join(config.Current().Mower.DataDirectory, recordingDirectory, name)
+}
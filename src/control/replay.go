@@ -0,0 +1,251 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/control/drivers"
+)
+
+type replayStruct struct {
+	file    string
+	speed   float64
+	session SessionRecord
+	// when the recording started, records are played back at their offset from it
+	started time.Time
+
+	// how the state differed from the recording at the last snapshot, empty while they agree
+	diverged string
+}
+
+var (
+	// set by OpenReplay before the controller starts, the hardware is left alone while it is
+	replaying *replayStruct
+
+	// feed each kind of record back in where the hardware or a client would have
+	replayHandlers = map[string]func(data json.RawMessage) error{
+		RecordPower: func(data json.RawMessage) error {
+			var power map[string]PowerChannelStruct
+			if err := json.Unmarshal(data, &power); err != nil {
+				return err
+			}
+
+			UpdatePower(power)
+			return nil
+		},
+		RecordIMU: func(data json.RawMessage) error {
+			var imu drivers.MPUData
+			if err := json.Unmarshal(data, &imu); err != nil {
+				return err
+			}
+
+			SetIMUValues(&imu)
+			return nil
+		},
+		RecordTemperature: func(data json.RawMessage) error {
+			var celsius float64
+			if err := json.Unmarshal(data, &celsius); err != nil {
+				return err
+			}
+
+			SetBatteryTemperature(celsius)
+			return nil
+		},
+		RecordPose: func(data json.RawMessage) error {
+			var pose Pose
+			if err := json.Unmarshal(data, &pose); err != nil {
+				return err
+			}
+
+			SetPose(pose)
+			return nil
+		},
+		RecordCommand: func(data json.RawMessage) error {
+			var command CommandRecord
+			if err := json.Unmarshal(data, &command); err != nil {
+				return err
+			}
+
+			var replayed string
+			if _, err := ExecuteCommand(command.Caller, command.Method, command.Payload); err != nil {
+				replayed = err.Message
+			}
+			if replayed != command.Error {
+				return fmt.Errorf("%v was %v when recorded and %v now", command.Method, commandOutcome(command.Error), commandOutcome(replayed))
+			}
+
+			return nil
+		},
+		RecordDisconnect: func(data json.RawMessage) error {
+			var caller ControllerIdentity
+			if err := json.Unmarshal(data, &caller); err != nil {
+				return err
+			}
+
+			clientDisconnected(caller)
+			return nil
+		},
+	}
+)
+
+// OpenReplay reads the session record of a recording and runs the controller from it in place of the hardware, it must be called before StartController
+func OpenReplay(file string, speed float64) error {
+	if speed <= 0 {
+		return errors.New("speed must be more than 0")
+	}
+
+	r := &replayStruct{file: file, speed: speed}
+
+	errSession := errors.New("session read")
+	err := readRecording(file, func(record RecordStruct) error {
+		if record.Kind != RecordSession {
+			return errors.New("not a recording, it does not start with a session record")
+		}
+		if err := json.Unmarshal(record.Data, &r.session); err != nil {
+			return err
+		}
+
+		r.started = record.Time
+		return errSession
+	})
+	if err == nil {
+		err = errors.New("the recording is empty")
+	}
+	if err != errSession {
+		return err
+	}
+	if r.session.Version > recordingVersion {
+		return fmt.Errorf("recording version %v is newer than this build understands", r.session.Version)
+	}
+
+	// the tuning the recording ran with, the server, auth and data settings stay as they are on this machine
+	recorded := r.session.Config
+	cfg := *config.Current()
+	cfg.Mower.CutterWidth = recorded.Mower.CutterWidth
+	cfg.Navigation = recorded.Navigation
+	cfg.Control = recorded.Control
+	cfg.Drive = recorded.Drive
+	cfg.Coverage = recorded.Coverage
+	cfg.Dock = recorded.Dock
+	cfg.PowerMonitors = recorded.PowerMonitors
+	cfg.Battery = recorded.Battery
+	cfg.Protection = recorded.Protection
+
+	changed, _, err := config.Apply(&cfg)
+	if err != nil {
+		return fmt.Errorf("recorded config: %v", err)
+	}
+	if len(changed) > 0 {
+		log.Infof("replay: using the recorded %v", strings.Join(changed, ", "))
+	}
+
+	replaying = r
+
+	return nil
+}
+
+// Replaying reports whether the controller is running from a recording rather than the hardware
+func Replaying() bool {
+	return replaying != nil
+}
+
+// restore puts back the job the recording started with in place of the one saved on this machine
+func (r *replayStruct) restore() {
+	if r.session.Job == nil {
+		return
+	}
+
+	MowerController.job = r.session.Job
+	updateJobState()
+}
+
+// run plays the records back at their recorded pace divided by speed, anything that depends on the wall clock such as protection durations only matches at speed 1
+func (r *replayStruct) run() {
+	name := filepath.Base(r.file)
+	log.Infof("replay: %v recorded by %v at %v, speed %v", name, r.session.Mower, r.started.Format(time.RFC3339), r.speed)
+	Do(func() {
+		RecordEvent(EventSeverityInfo, EventTypeSystem, "replay of "+name+" started", nil)
+	})
+
+	start := time.Now()
+	err := readRecording(r.file, func(record RecordStruct) error {
+		offset := record.Time.Sub(r.started)
+		if wait := time.Duration(float64(offset)/r.speed) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if record.Kind == RecordState {
+			r.compareState(offset, record.Data)
+			return nil
+		}
+
+		handler, ok := replayHandlers[record.Kind]
+		if !ok {
+			return nil
+		}
+
+		Do(func() {
+			if err := handler(record.Data); err != nil {
+				log.Warnf("replay: +%v %v: %v", offset.Round(time.Millisecond), record.Kind, err)
+			}
+		})
+
+		return nil
+	})
+	if err != nil {
+		log.Errorf("unable to replay %v: %v", name, err)
+	}
+
+	log.Infof("replay: %v finished", name)
+	Do(func() {
+		RecordEvent(EventSeverityInfo, EventTypeSystem, "replay of "+name+" finished", nil)
+	})
+}
+
+// compareState logs when the replayed state stops or starts matching a recorded snapshot, the statuses are compared rather than the readings which drift with timing
+func (r *replayStruct) compareState(offset time.Duration, data json.RawMessage) {
+	var recorded MowerStateStruct
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return
+	}
+
+	var differences []string
+	Do(func() {
+		compare := func(name string, was string, now string) {
+			if was != now {
+				differences = append(differences, name+" "+was+" recorded, "+now+" replayed")
+			}
+		}
+
+		compare("mode", recorded.Mode, MowerState.Mode)
+		compare("job", recorded.Job.Status, MowerState.Job.Status)
+		compare("navigation", recorded.Navigation.Status, MowerState.Navigation.Status)
+		compare("dock", recorded.Dock.Status, MowerState.Dock.Status)
+		compare("protection", recorded.Protection.Level, MowerState.Protection.Level)
+	})
+
+	diverged := strings.Join(differences, ", ")
+	if diverged == r.diverged {
+		return
+	}
+	r.diverged = diverged
+
+	if diverged == "" {
+		log.Infof("replay: +%v back in step with the recording", offset.Round(time.Millisecond))
+	} else {
+		log.Warnf("replay: +%v differs from the recording: %v", offset.Round(time.Millisecond), diverged)
+	}
+}
+
+func commandOutcome(err string) string {
+	if err == "" {
+		return "run"
+	}
+
+	return "refused (" + err + ")"
+}
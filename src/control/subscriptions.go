@@ -0,0 +1,219 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	TopicBattery  = "battery"
+	TopicIMU      = "imu"
+	TopicPose     = "pose"
+	TopicPlatform = "platform"
+	TopicJob      = "job"
+	TopicFaults   = "faults"
+
+	// subscriptions are checked this often, so it is also the fastest any topic can be sent
+	subscriptionInterval = 50 * time.Millisecond
+
+	// rates are in Hz
+	defaultTopicRate = 1.0
+	minTopicRate     = 0.1
+	maxTopicRate     = 20.0
+)
+
+var (
+	// topics maps each subscribable topic to the parts of the mower state it carries
+	topics = map[string]func() interface{}{
+		TopicState: func() interface{} { return MowerState },
+		TopicBattery: func() interface{} {
+			return map[string]interface{}{"battery": MowerState.Battery, "power": MowerState.Power}
+		},
+		TopicIMU: func() interface{} {
+			return map[string]interface{}{"imu": MowerState.IMU, "compass": MowerState.Compass, "gps": MowerState.GPS}
+		},
+		TopicPose: func() interface{} {
+			return map[string]interface{}{"pose": MowerState.Pose, "navigation": MowerState.Navigation, "drive": MowerState.Drive}
+		},
+		TopicPlatform: func() interface{} {
+			return map[string]interface{}{"platform": MowerState.Platform}
+		},
+		TopicJob: func() interface{} {
+			return map[string]interface{}{"mode": MowerState.Mode, "job": MowerState.Job, "dock": MowerState.Dock, "cutter": MowerState.Cutter}
+		},
+		TopicControl: func() interface{} {
+			return map[string]interface{}{"control": MowerState.Control}
+		},
+		TopicFaults: func() interface{} {
+			return map[string]interface{}{"protection": MowerState.Protection}
+		},
+	}
+)
+
+type TopicSubscription struct {
+	Topic string `json:"topic"`
+	// Hz, defaults to 1
+	Rate float64 `json:"rate,omitempty"`
+}
+
+type SubscribePayload struct {
+	Topics []TopicSubscription `json:"topics"`
+}
+
+// subscriptionStruct tracks what a client was last sent on a topic so only the changes go out next time
+type subscriptionStruct struct {
+	topic    string
+	interval time.Duration
+	nextAt   time.Time
+	seq      int
+	last     map[string]interface{}
+}
+
+// TopicNames lists every topic clients may subscribe to
+func TopicNames() []string {
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (p *SubscribePayload) Validate() error {
+	if len(p.Topics) == 0 {
+		return errors.New("topics must contain at least one topic")
+	}
+
+	for _, t := range p.Topics {
+		if _, ok := topics[t.Topic]; !ok {
+			return errors.New("unknown topic " + t.Topic)
+		}
+		if t.Rate != 0 && (t.Rate < minTopicRate || t.Rate > maxTopicRate) {
+			return errors.New("rate for " + t.Topic + " must be between 0.1 and 20Hz")
+		}
+	}
+
+	return nil
+}
+
+// subscribe adds or updates topic subscriptions, the next message on each is a full snapshot
+func (c *wsClientStruct) subscribe(payload *SubscribePayload) {
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]*subscriptionStruct)
+	}
+
+	for _, t := range payload.Topics {
+		rate := t.Rate
+		if rate == 0 {
+			rate = defaultTopicRate
+		}
+
+		c.subscriptions[t.Topic] = &subscriptionStruct{
+			topic:    t.Topic,
+			interval: time.Duration(float64(time.Second) / rate),
+		}
+	}
+}
+
+func (c *wsClientStruct) unsubscribe(payload *SubscribePayload) {
+	for _, t := range payload.Topics {
+		delete(c.subscriptions, t.Topic)
+	}
+}
+
+// activeSubscriptions lists the client's subscriptions for acknowledging a change
+func (c *wsClientStruct) activeSubscriptions() []TopicSubscription {
+	active := []TopicSubscription{}
+	for _, s := range c.subscriptions {
+		active = append(active, TopicSubscription{Topic: s.topic, Rate: float64(time.Second) / float64(s.interval)})
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Topic < active[j].Topic })
+
+	return active
+}
+
+// wsPublishSubscriptions sends each subscribed topic that is due, it must only be called from the controller loop
+func (m *MowerControllerStruct) wsPublishSubscriptions() {
+	now := time.Now()
+
+	// each topic is only encoded once per pass however many clients want it
+	snapshots := make(map[string]map[string]interface{})
+
+	for client := range m.wsClients {
+		for _, s := range client.subscriptions {
+			if now.Before(s.nextAt) {
+				continue
+			}
+			s.nextAt = now.Add(s.interval)
+
+			snapshot, ok := snapshots[s.topic]
+			if !ok {
+				snapshot = topicSnapshot(s.topic)
+				snapshots[s.topic] = snapshot
+			}
+
+			envelope := Envelope{Type: MessageTypeState, Topic: s.topic, Payload: snapshot}
+			if s.last != nil {
+				delta := diffState(s.last, snapshot)
+				if len(delta) == 0 {
+					continue
+				}
+				envelope.Payload = delta
+				envelope.Delta = true
+			}
+
+			s.seq++
+			envelope.Seq = s.seq
+			s.last = snapshot
+
+			m.wsReply(client, envelope)
+		}
+	}
+}
+
+// topicSnapshot encodes a topic into plain JSON values so it can be compared field by field
+func topicSnapshot(topic string) map[string]interface{} {
+	snapshot := make(map[string]interface{})
+
+	data, err := json.Marshal(topics[topic]())
+	if err == nil {
+		json.Unmarshal(data, &snapshot)
+	}
+
+	return snapshot
+}
+
+// diffState returns the fields of next that differ from prev, nested objects are compared recursively and removed fields come back as null
+func diffState(prev map[string]interface{}, next map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+
+	for key, value := range next {
+		old, ok := prev[key]
+		if !ok {
+			delta[key] = value
+			continue
+		}
+
+		oldMap, oldIsMap := old.(map[string]interface{})
+		newMap, newIsMap := value.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			if d := diffState(oldMap, newMap); len(d) > 0 {
+				delta[key] = d
+			}
+		} else if !reflect.DeepEqual(old, value) {
+			delta[key] = value
+		}
+	}
+
+	for key := range prev {
+		if _, ok := next[key]; !ok {
+			delta[key] = nil
+		}
+	}
+
+	return delta
+}
@@ -27,7 +27,6 @@ package control
 
 import (
 	"errors"
-	"log"
 	"math"
 	"time"
 
@@ -60,36 +59,26 @@ func InitFilters() {
 }
 
 func SetIMUValues(data *drivers.MPUData) {
+	record(RecordIMU, data)
+
 	newTime := time.Now()
 	deltaTime := newTime.Sub(IMUDeltaTime)
 	IMUDeltaTime = newTime
 
 	dt := float64(deltaTime / time.Millisecond)
 
-	// log the values
-	log.Println("----------")
-	log.Printf("IMU dt: %v", dt)
-	log.Printf("IMU Temperature: %v", data.Temp)
-	log.Printf("IMU Accelerometer: %v, %v, %v", data.A1, data.A2, data.A3)
-	log.Printf("IMU Gyroscope: %v, %v, %v", data.G1, data.G2, data.G3)
-	log.Printf("IMU Magnetometer: %v, %v, %v", data.M1, data.M2, data.M3)
-
-	/*log.Println("----------")
-	log.Printf("IMU roll: %v", roll)
-	log.Printf("IMU gyroXangle: %v", gyroXangle)
-	log.Printf("IMU kalAngle_X: %v", kalAngle_X)
-
-	log.Printf("IMU pitch: %v", pitch)
-	log.Printf("IMU gyroYangle: %v", gyroYangle)
-	log.Printf("IMU kalAngle_Y: %v", kalAngle_Y)
-	log.Println("----------")
-	*/
+	imuLog.Debugf("dt %v temperature %v accelerometer %v, %v, %v gyroscope %v, %v, %v magnetometer %v, %v, %v",
+		dt, data.Temp, data.A1, data.A2, data.A3, data.G1, data.G2, data.G3, data.M1, data.M2, data.M3)
+
+	MowerState.IMU.Accelerometer = [3]float64{data.A1, data.A2, data.A3}
+	MowerState.IMU.Gyroscope = [3]float64{data.G1, data.G2, data.G3}
+	MowerState.IMU.Magnetometer = [3]float64{data.M1, data.M2, data.M3}
+	MowerState.IMU.Temperature = data.Temp
+	MowerState.IMU.Updated = newTime
 
 	heading, label, err := CurrentHeading(data.M1, data.M2)
 	if err == nil {
-
-		log.Printf("CurrentHeading: %v, %v", heading, label)
-		log.Println("----------")
+		headingLog.Debugf("heading %v, %v", heading, label)
 	}
 
 }
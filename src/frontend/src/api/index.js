@@ -3,18 +3,67 @@ import VueNativeSock from 'vue-native-websocket'
 import axios from 'axios'
 
 import store from '../store'
+import router from '../router'
 
 
 //const endpointsURL = 'http://' + location.hostname + ':8088/v1/endpoints'
-const endpointsURL = 'http://robot-mower.local:8088/v1/endpoints'
+// follow the page onto https when the mower serves TLS
+const endpointsURL = location.protocol + '//robot-mower.local:8088/v1/endpoints'
+const loginURL = location.protocol + '//robot-mower.local:8088/v1/auth/login'
+
+const tokenKey = 'mowerToken'
+
+// the websocket and camera stream can't send headers so they carry the token in the query
+function withToken(url) {
+  var token = localStorage.getItem(tokenKey)
+  if (!url || !token) {
+    return url
+  }
+  return url + (url.indexOf('?') < 0 ? '?' : '&') + 'token=' + encodeURIComponent(token)
+}
+
+if (localStorage.getItem(tokenKey)) {
+  axios.defaults.headers.common['Authorization'] = 'Bearer ' + localStorage.getItem(tokenKey)
+}
+
+// an expired or revoked token gets a 401 from every request, drop it and go back to the login page
+axios.interceptors.response.use(null, function (error) {
+  if (error.response && error.response.status === 401) {
+    localStorage.removeItem(tokenKey)
+    delete axios.defaults.headers.common['Authorization']
+    
+    if (router.currentRoute.name !== 'Login') {
+      router.push({ name: 'Login' })
+    }
+  }
+  return Promise.reject(error)
+})
 
 const fallbackCameraImage = 'https://media.giphy.com/media/3o6vXRxrhj7Ov94Gbu/source.gif'
 
 export default {
+  isLoggedIn() {
+    return localStorage.getItem(tokenKey) !== null
+  },
+  
+  login(username, password, callback) {
+    axios.post(loginURL, { username: username, password: password })
+      .then(response => {
+        localStorage.setItem(tokenKey, response.data.token)
+        axios.defaults.headers.common['Authorization'] = 'Bearer ' + response.data.token
+        
+        callback(null, response.data.principal)
+      }).catch(function (error) {
+        callback(error.response ? error.response.data.error : error.message)
+      })
+  },
+  
   getEndpoints(callback) {
     axios.get(endpointsURL) // this needs to be dynamic
       .then(response => {
         response.isFallbackValues = false
+        response.data.camera = withToken(response.data.camera)
+        response.data.ws = withToken(response.data.ws)
         
         Vue.use(VueNativeSock, response.data.ws, { store: store, format: 'json' })
         
@@ -3,6 +3,7 @@ import Router from 'vue-router'
 
 import Welcome from '@/views/Welcome.vue'
 import Control from '@/views/Control.vue'
+import Login from '@/views/Login.vue'
 import NotImplemented from '@/views/NotImplemented.vue'
 
 import StatusBar from '@/components/StatusBar.vue'
@@ -21,6 +22,11 @@ export default new Router({
       name: 'Welcome',
       component: Welcome,
     },
+    {
+      path: '/login',
+      name: 'Login',
+      component: Login,
+    },
     {
       path: '/control',
       name: 'Control',
@@ -36,9 +36,14 @@ const state = {
     voltage_nominal: null,
     voltage_warn: null,
     voltage: null,
-    current: null
+    current: null,
+    state_of_charge: null,
+    remaining_capacity: null,
+    remaining_runtime: -1
   },
   
+  power: {},
+  
   compass: {
     status: null,
     bearing: null
@@ -52,12 +57,76 @@ const state = {
   
   drive: {
     speed: 100,
+    command: {
+      linear: 0,
+      angular: 0
+    },
+    left: 0,
+    right: 0,
     direction: null
   },
   
   cutter: {
     speed: 0
   },
+  
+  pose: {
+    x: 0,
+    y: 0,
+    heading: 0
+  },
+  
+  navigation: {
+    status: null,
+    waypoint: 0,
+    waypoint_count: 0,
+    cross_track_error: 0,
+    command: {
+      linear: 0,
+      angular: 0
+    }
+  },
+  
+  mode: null,
+  
+  job: {
+    id: null,
+    zone: null,
+    status: null,
+    waypoint: 0,
+    waypoint_count: 0,
+    percent_complete: 0,
+    percent_covered: 0,
+    energy_wh: 0,
+    area_mowed: 0
+  },
+  
+  dock: {
+    status: null,
+    reason: null,
+    charging: false
+  },
+  
+  control: {
+    holder: null,
+    acquired_at: null,
+    expires_at: null
+  },
+  
+  controlEvent: null,
+  
+  // the last command the mower refused, with its error code and message
+  commandError: null,
+  
+  protection: {
+    level: null,
+    faults: []
+  },
+  
+  protectionEvents: [],
+
+  // the event log as it happens, GET /v1/events has the history
+  events: [],
 }
 
 // getters
@@ -80,12 +149,33 @@ const mutations = {
   setMowerState(state, event) {
     state.platform = event.platform
     state.battery = event.battery
+    state.power = event.power
     state.compass = event.compass
     state.gps = event.gps
     state.drive = event.drive
     state.cutter = event.cutter
+    state.pose = event.pose
+    state.navigation = event.navigation
+    state.mode = event.mode
+    state.job = event.job
+    state.dock = event.dock
+    state.control = event.control
+    state.protection = event.protection
     
     console.log(event)
+  },
+  setControlEvent(state, message) {
+    state.controlEvent = message.event
+  },
+  setCommandError(state, message) {
+    state.commandError = { method: message.method, error: message.error }
+  },
+  addProtectionEvent(state, message) {
+    // keep the most recent events only
+    state.protectionEvents = [message.event].concat(state.protectionEvents).slice(0, 50)
+  },
+  addEvent(state, message) {
+    state.events = [message.event].concat(state.events).slice(0, 50)
   }
 }
 
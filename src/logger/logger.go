@@ -0,0 +1,343 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// a subsystem with no level of its own follows the default
+	levelDefault = -1
+)
+
+var (
+	levels     = []string{LevelDebug, LevelInfo, LevelWarn, LevelError}
+	levelValue = map[string]int32{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+	defaultLevel = levelValue[LevelInfo]
+	jsonOutput   int32
+
+	subsystems    = make(map[string]*subsystemStruct)
+	subsystemLock sync.Mutex
+
+	output     io.Writer = os.Stderr
+	outputLock sync.Mutex
+)
+
+// SettingsStruct is the logging setup, Subsystems maps each subsystem to its level, an empty level follows Level
+type SettingsStruct struct {
+	Level      string            `json:"level"`
+	Format     string            `json:"format"`
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+type subsystemStruct struct {
+	name  string
+	level int32
+}
+
+// Logger writes leveled messages for one subsystem, with the fields added by With on every line
+type Logger struct {
+	subsystem *subsystemStruct
+	fields    []interface{}
+	sampler   *samplerStruct
+}
+
+// samplerStruct lets through at most one message per interval and counts the rest
+type samplerStruct struct {
+	interval time.Duration
+	next     time.Time
+	dropped  int
+	lock     sync.Mutex
+}
+
+// New returns the logger for a subsystem, every logger for the same subsystem shares its level
+func New(subsystem string) *Logger {
+	subsystemLock.Lock()
+	defer subsystemLock.Unlock()
+
+	s, ok := subsystems[subsystem]
+	if !ok {
+		s = &subsystemStruct{name: subsystem, level: levelDefault}
+		subsystems[subsystem] = s
+	}
+
+	return &Logger{subsystem: s}
+}
+
+// With returns a logger that adds the key value pairs to every message
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), keyvals...)
+
+	return &child
+}
+
+// Sampled returns a logger that writes at most one message per interval, for readings that arrive many times a second
+func (l *Logger) Sampled(interval time.Duration) *Logger {
+	child := *l
+	child.sampler = &samplerStruct{interval: interval}
+
+	return &child
+}
+
+// Enabled reports whether a message at level would be written, so expensive arguments can be skipped
+func (l *Logger) Enabled(level string) bool {
+	threshold := atomic.LoadInt32(&l.subsystem.level)
+	if threshold == levelDefault {
+		threshold = atomic.LoadInt32(&defaultLevel)
+	}
+
+	return levelValue[level] >= threshold
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LevelDebug, format, args)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LevelInfo, format, args)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LevelWarn, format, args)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LevelError, format, args)
+}
+
+// Fatalf writes an error whatever the level and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, args...), l.fields)
+	os.Exit(1)
+}
+
+// Writer returns a writer that logs each line written to it at level, for libraries that log through the standard log package
+func (l *Logger) Writer(level string) io.Writer {
+	return writerStruct{logger: l, level: level}
+}
+
+type writerStruct struct {
+	logger *Logger
+	level  string
+}
+
+func (w writerStruct) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.write(w.level, "%v", []interface{}{line})
+	}
+
+	return len(p), nil
+}
+
+func (l *Logger) write(level string, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := l.fields
+	if l.sampler != nil {
+		dropped, ok := l.sampler.allow()
+		if !ok {
+			return
+		}
+		if dropped > 0 {
+			fields = append(append([]interface{}{}, fields...), "dropped", dropped)
+		}
+	}
+
+	l.output(level, fmt.Sprintf(format, args...), fields)
+}
+
+func (l *Logger) output(level string, message string, fields []interface{}) {
+	now := time.Now()
+
+	var line []byte
+	if atomic.LoadInt32(&jsonOutput) == 1 {
+		entry := map[string]interface{}{
+			"time":      now.Format(time.RFC3339Nano),
+			"level":     level,
+			"subsystem": l.subsystem.name,
+			"msg":       message,
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry[fmt.Sprint(fields[i])] = fields[i+1]
+		}
+
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": level, "subsystem": l.subsystem.name, "msg": message})
+		}
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%v %-5v %v: %v", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level), l.subsystem.name, message)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		}
+		line = []byte(b.String())
+	}
+
+	outputLock.Lock()
+	output.Write(append(line, '\n'))
+	outputLock.Unlock()
+}
+
+func (s *samplerStruct) allow() (dropped int, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Before(s.next) {
+		s.dropped++
+		return 0, false
+	}
+
+	dropped = s.dropped
+	s.dropped = 0
+	s.next = now.Add(s.interval)
+
+	return dropped, true
+}
+
+// Configure replaces the whole setup, subsystems left out of settings go back to the default level
+func Configure(settings SettingsStruct) error {
+	if err := Check(settings); err != nil {
+		return err
+	}
+
+	subsystemLock.Lock()
+	for _, s := range subsystems {
+		atomic.StoreInt32(&s.level, levelDefault)
+	}
+	subsystemLock.Unlock()
+
+	if settings.Level == "" {
+		settings.Level = LevelInfo
+	}
+	if settings.Format == "" {
+		settings.Format = FormatText
+	}
+
+	apply(settings)
+
+	return nil
+}
+
+// Update changes only what settings sets, an empty subsystem level puts it back on the default
+func Update(settings SettingsStruct) error {
+	if err := Check(settings); err != nil {
+		return err
+	}
+
+	apply(settings)
+
+	return nil
+}
+
+// Settings returns the current setup with the level of every subsystem, empty where it follows the default
+func Settings() SettingsStruct {
+	settings := SettingsStruct{
+		Format:     FormatText,
+		Subsystems: make(map[string]string),
+	}
+
+	settings.Level = levelName(atomic.LoadInt32(&defaultLevel))
+	if atomic.LoadInt32(&jsonOutput) == 1 {
+		settings.Format = FormatJSON
+	}
+
+	subsystemLock.Lock()
+	defer subsystemLock.Unlock()
+
+	for name, s := range subsystems {
+		settings.Subsystems[name] = levelName(atomic.LoadInt32(&s.level))
+	}
+
+	return settings
+}
+
+// ValidLevel reports whether level is one of the level names
+func ValidLevel(level string) bool {
+	_, ok := levelValue[level]
+	return ok
+}
+
+// Check reports everything wrong with settings without applying them
+func Check(settings SettingsStruct) error {
+	var problems []string
+
+	if settings.Level != "" && !ValidLevel(settings.Level) {
+		problems = append(problems, "level must be "+strings.Join(levels, ", "))
+	}
+	if settings.Format != "" && settings.Format != FormatText && settings.Format != FormatJSON {
+		problems = append(problems, "format must be text or json")
+	}
+
+	subsystemLock.Lock()
+	for name, level := range settings.Subsystems {
+		if _, ok := subsystems[name]; !ok {
+			problems = append(problems, "unknown subsystem "+name)
+		} else if level != "" && !ValidLevel(level) {
+			problems = append(problems, name+" level must be "+strings.Join(levels, ", "))
+		}
+	}
+	subsystemLock.Unlock()
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func apply(settings SettingsStruct) {
+	if settings.Level != "" {
+		atomic.StoreInt32(&defaultLevel, levelValue[settings.Level])
+	}
+
+	if settings.Format == FormatJSON {
+		atomic.StoreInt32(&jsonOutput, 1)
+	} else if settings.Format == FormatText {
+		atomic.StoreInt32(&jsonOutput, 0)
+	}
+
+	subsystemLock.Lock()
+	defer subsystemLock.Unlock()
+
+	for name, level := range settings.Subsystems {
+		value := int32(levelDefault)
+		if level != "" {
+			value = levelValue[level]
+		}
+		atomic.StoreInt32(&subsystems[name].level, value)
+	}
+}
+
+func levelName(value int32) string {
+	for name, v := range levelValue {
+		if v == value {
+			return name
+		}
+	}
+
+	return ""
+}
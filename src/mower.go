@@ -1,15 +1,18 @@
 package main
 
 import (
-	"log"
+	stdlog "log"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
 	"github.com/dchote/robot-mower/src/api"
+	"github.com/dchote/robot-mower/src/auth"
 	"github.com/dchote/robot-mower/src/config"
 	"github.com/dchote/robot-mower/src/control"
+	"github.com/dchote/robot-mower/src/logger"
 	"github.com/dchote/robot-mower/src/vision"
 
 	"github.com/GeertJohan/go.rice"
@@ -21,30 +24,70 @@ const VERSION = "0.0.1"
 var (
 	err          error
 	staticAssets *rice.Box
+
+	log = logger.New("mower")
 )
 
 func cliArguments() {
 	usage := `
-Usage: mower [options]
+Usage: mower [options] [--set=<key=value>...]
 
 Options:
-  -c, --config=<json>           Specify config file [default: ./config.json]
-	-d, --camera-device=<device>  Specify the devide id of the camera [default: 0]
+  -c, --config=<file>           Specify config file, JSON, YAML (.yaml, .yml) or TOML (.toml) [default: ./config.json]
+  -d, --camera-device=<device>  Override the device id of the camera
+  -s, --set=<key=value>...      Override any config key, eg. --set apiServer.listenAddress=:8443
+  -r, --replay=<file>           Run the controller from a recording in place of the hardware
+  --replay-speed=<factor>       Play the recording faster or slower [default: 1]
   -h, --help                    Show this screen.
   -v, --version                 Show version.
+
+Config keys can also be set with MOWER_ environment variables, eg. MOWER_API_SERVER_LISTEN_ADDRESS=:8443,
+the command line wins over the environment and the environment over the file. Values other than strings are JSON.
 `
 	args, _ := docopt.ParseArgs(usage, os.Args[1:], VERSION)
 
-	config.ConfigFile, _ = args.String("--config")
+	configFile, _ := args.String("--config")
+
+	var overrides []string
+	if device, err := args.String("--camera-device"); err == nil {
+		overrides = append(overrides, "mower.cameraDeviceID="+device)
+	}
+	if set, ok := args["--set"].([]string); ok {
+		overrides = append(overrides, set...)
+	}
 
-	err = config.LoadConfig(config.ConfigFile)
+	err = config.LoadConfig(configFile, overrides)
 	if err != nil {
-		log.Fatalf("Unable to load "+config.ConfigFile+" ERROR=", err)
+		log.Fatalf("Unable to load config: %v", err)
 	}
 
-	config.Config.Mower.CameraDeviceID, _ = args.Int("--camera-device")
+	configureLogging()
 
-	log.Printf("Config: %+v", config.Config)
+	if file, err := args.String("--replay"); err == nil {
+		speed, err := args.Float64("--replay-speed")
+		if err == nil {
+			err = control.OpenReplay(file, speed)
+		}
+		if err != nil {
+			log.Fatalf("Unable to replay %v: %v", file, err)
+		}
+	}
+
+	log.Debugf("Config: %+v", config.Current())
+}
+
+// configureLogging applies the logging section, levels changed through the API are lost when the config changes
+func configureLogging() {
+	cfg := config.Current()
+
+	err := logger.Configure(logger.SettingsStruct{
+		Level:      cfg.Logging.Level,
+		Format:     cfg.Logging.Format,
+		Subsystems: cfg.Logging.Subsystems,
+	})
+	if err != nil {
+		log.Errorf("Unable to configure logging: %v", err)
+	}
 }
 
 func exitCleanup() {
@@ -52,6 +95,10 @@ func exitCleanup() {
 }
 
 func main() {
+	// gobot and the other libraries log through the standard logger
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logger.New("lib").Writer(logger.LevelInfo))
+
 	cliArguments()
 
 	staticAssets, err = rice.FindBox("frontend/dist")
@@ -59,18 +106,55 @@ func main() {
 		log.Fatalf("Static assets not found. Build them first.")
 	}
 
+	err = auth.Init()
+	if err != nil {
+		log.Fatalf("Unable to set up authentication: %v", err)
+	}
+	config.OnChange(func(old *config.ConfigStruct, cfg *config.ConfigStruct) {
+		if !reflect.DeepEqual(old.Logging, cfg.Logging) {
+			configureLogging()
+		}
+		if !reflect.DeepEqual(old.Auth, cfg.Auth) {
+			if err := auth.Init(); err != nil {
+				log.Errorf("Unable to reload authentication: %v", err)
+			}
+		}
+	})
+
 	vision.StartVision()
 	defer vision.StopVision()
 
 	control.StartController()
 
-	go api.StartServer(*config.Config, staticAssets)
+	go api.StartServer(*config.Current(), staticAssets)
+
+	// pick up edits to the config file without restarting the robot, a replay keeps the tuning it was recorded with
+	if control.Replaying() {
+		log.Infof("Config reloading is off while replaying")
+	} else {
+		go config.WatchConfig()
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-	<-shutdown
 
-	log.Println("Shutting down")
+	for running := true; running; {
+		select {
+		case <-reload:
+			if control.Replaying() {
+				log.Warnf("Ignoring SIGHUP while replaying")
+			} else {
+				config.ReloadConfig("SIGHUP")
+			}
+		case <-shutdown:
+			running = false
+		}
+	}
+
+	log.Infof("Shutting down")
 
 	// shut down listener, with a hard timeout
 	api.StopServer()
@@ -1,10 +1,10 @@
 package vision
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/dchote/robot-mower/src/config"
+	"github.com/dchote/robot-mower/src/logger"
 
 	"github.com/hybridgroup/mjpeg"
 	"gocv.io/x/gocv"
@@ -16,14 +16,16 @@ var (
 	camera   *gocv.VideoCapture
 
 	Stream *mjpeg.Stream
+
+	log = logger.New("vision")
 )
 
 func StartVision() {
-	deviceID = config.Config.Mower.CameraDeviceID
+	deviceID = config.Current().Mower.CameraDeviceID
 
 	camera, err = gocv.OpenVideoCapture(deviceID)
 	if err != nil {
-		fmt.Printf("Error opening capture device: %v\n", deviceID)
+		log.Errorf("unable to open capture device %v: %v", deviceID, err)
 		return
 	}
 	//defer camera.Close()
@@ -48,7 +50,7 @@ func CaptureVideo() {
 		time.Sleep(100 * time.Millisecond)
 
 		if ok := camera.Read(&img); !ok {
-			fmt.Printf("Device closed: %v\n", deviceID)
+			log.Warnf("capture device %v closed", deviceID)
 			return
 		}
 		if img.Empty() {